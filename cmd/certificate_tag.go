@@ -27,19 +27,36 @@
 // arbitrary data in extensions. Since they are also not hashed when verifying
 // signatures, that data can also be changed without invalidating it.
 //
-// The tool supports PE32 exe files and MSI files.
+// The tool supports PE32 exe files, MSI files, APPX/MSIX packages and
+// Windows security catalog (.cat) files.
 package main
 
 import (
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/gesellix/windows-authenticode-cert-tagging/pkg"
+	"github.com/gesellix/windows-authenticode-cert-tagging/pkg/sign"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 )
 
+// ownedOIDTags collects repeated -set-cert-tag=OID:value flags.
+type ownedOIDTags []string
+
+func (o *ownedOIDTags) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *ownedOIDTags) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
 var (
 	dumpAppendedTag       *bool   = flag.Bool("dump-appended-tag", false, "If set, any appended tag is dumped to stdout.")
 	removeAppendedTag     *bool   = flag.Bool("remove-appended-tag", false, "If set, any appended tag is removed and the binary rewritten.")
@@ -49,8 +66,55 @@ var (
 	savePKCS7             *string = flag.String("save-pkcs7", "", "If set to a filename, the PKCS7 data from the original binary will be written to that file.")
 	outFilename           *string = flag.String("out", "", "If set, the updated binary is written to this file. Otherwise the binary is updated in place.")
 	printTagDetails       *bool   = flag.Bool("print-tag-details", false, "IF set, print to stdout the location and size of the superfluous cert's Gact2.0 marker plus buffer.")
+	verify                *bool   = flag.Bool("verify", false, "If set, the binary's Authenticode signature is fully verified (including chain validation) rather than merely inspected.")
+	verifyRoots           *string = flag.String("verify-roots", "", "A PEM file of root certificates to verify against when --verify is set. If empty, the host's default root pool is used.")
+	signPKCS12            *string = flag.String("sign-pkcs12", "", "If set, this flag contains a filename of a PKCS#12 (.pfx) file holding a key and certificate chain, and the binary is signed from scratch with it, replacing any existing signature.")
+	signPassword          *string = flag.String("sign-password", "", "The password protecting the file named by --sign-pkcs12.")
+	timestampURL          *string = flag.String("timestamp-url", "", "If set together with --sign-pkcs12, an RFC 3161 timestamp for the new signature is requested from this URL and embedded as a counter-signature.")
+	setCertTags           ownedOIDTags
+	dumpCertTags          *bool = flag.Bool("dump-cert-tags", false, "If set, every superfluous-cert tag found in the binary is dumped to stdout, prefixed by the OID it was stored under.")
 )
 
+func init() {
+	flag.Var(&setCertTags, "set-cert-tag", "Sets a superfluous certificate tag under a specific OID, as OID:value (e.g. 1.3.6.1.4.1.11129.2.1.9001:0xdeadbeef). May be repeated to set tags under more than one OID; subject to the same length and '0x' rules as -set-superfluous-cert-tag.")
+}
+
+// parseOID parses a dotted-decimal OID string, such as "1.3.6.1.4.1.11129.2.1.9001".
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID arc %q: %w", part, err)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// parseTagValue applies the same '0x' and padding rules as
+// -set-superfluous-cert-tag to a tag value string.
+func parseTagValue(value string) ([]byte, error) {
+	var tagContents []byte
+	var err error
+	if strings.HasPrefix(value, "0x") {
+		tagContents, err = hex.DecodeString(value[2:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse tag contents: %w", err)
+		}
+	} else {
+		tagContents = []byte(value)
+	}
+	for len(tagContents) < *paddedLength {
+		tagContents = append(tagContents, 0)
+	}
+	if len(tagContents) < 0x100 || len(tagContents) > 0xffff {
+		return nil, fmt.Errorf("want final tag length in range [256, 65535], got %d", len(tagContents))
+	}
+	return tagContents, nil
+}
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
@@ -78,7 +142,12 @@ func main() {
 	didSomething := false
 
 	if len(*savePKCS7) > 0 {
-		if err := ioutil.WriteFile(*savePKCS7, bin.Asn1Data(), 0644); err != nil {
+		asn1Data, err := bin.Asn1Data()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while reading PKCS#7 data: %s\n", err)
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(*savePKCS7, asn1Data, 0644); err != nil {
 			fmt.Fprintf(os.Stderr, "Error while writing file: %s\n", err)
 			os.Exit(1)
 		}
@@ -166,6 +235,59 @@ func main() {
 		didSomething = true
 	}
 
+	if len(setCertTags) > 0 {
+		curBin := bin
+		var contents []byte
+		for _, spec := range setCertTags {
+			sep := strings.Index(spec, ":")
+			if sep == -1 {
+				fmt.Fprintf(os.Stderr, "Malformed -set-cert-tag value %q, want OID:value\n", spec)
+				os.Exit(1)
+			}
+			oid, err := parseOID(spec[:sep])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while parsing -set-cert-tag OID: %s\n", err)
+				os.Exit(1)
+			}
+			tagContents, err := parseTagValue(spec[sep+1:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while parsing -set-cert-tag value: %s\n", err)
+				os.Exit(1)
+			}
+			contents, err = curBin.SetSuperfluousCertTagByOID(oid, tagContents)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while setting certificate tag for OID %s: %s\n", oid, err)
+				os.Exit(1)
+			}
+			if curBin, err = pkg.NewBinary(contents); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while re-reading binary after setting certificate tag: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		if err := ioutil.WriteFile(*outFilename, contents, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while writing updated file: %s\n", err)
+			os.Exit(1)
+		}
+		finalContents = contents
+		didSomething = true
+	}
+
+	if *dumpCertTags {
+		tags, err := bin.ListSuperfluousCertTags()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while listing certificate tags: %s\n", err)
+			os.Exit(1)
+		}
+		if len(tags) == 0 {
+			fmt.Printf("No superfluous-cert tags found\n")
+		}
+		for _, tag := range tags {
+			fmt.Printf("OID %s:\n", tag.OID)
+			os.Stdout.WriteString(hex.Dump(tag.Payload))
+		}
+		didSomething = true
+	}
+
 	if *printTagDetails {
 		if finalContents == nil {
 			// Re-read the input, as NewBinary() may modify it.
@@ -174,12 +296,69 @@ func main() {
 				panic(err)
 			}
 		}
-		offset, length, err := pkg.FindTag(finalContents, bin.CertificateOffset())
+		// A binary can carry more than one superfluous-cert tag (see
+		// --set-cert-tag), so report every one found rather than
+		// picking a single one arbitrarily.
+		tags, err := pkg.FindTags(finalContents, bin.CertificateOffset())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error while searching for tag in file bytes: %s\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("Omaha Tag offset, length: (%d, %d)\n", offset, length)
+		for _, tag := range tags {
+			fmt.Printf("Omaha Tag offset, length: (%d, %d)\n", tag.Offset, tag.Length)
+		}
+		didSomething = true
+	}
+
+	if len(*signPKCS12) > 0 {
+		pfxData, err := ioutil.ReadFile(*signPKCS12)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while reading %s: %s\n", *signPKCS12, err)
+			os.Exit(1)
+		}
+		signer, chain, err := sign.LoadPKCS12(pfxData, *signPassword)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while loading PKCS#12 file: %s\n", err)
+			os.Exit(1)
+		}
+		contents, err := bin.Sign(signer, chain, pkg.SignOptions{TimestampURL: *timestampURL})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while signing: %s\n", err)
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(*outFilename, contents, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while writing updated file: %s\n", err)
+			os.Exit(1)
+		}
+		finalContents = contents
+		didSomething = true
+	}
+
+	if *verify {
+		opts := pkg.VerifyOptions{}
+		if len(*verifyRoots) > 0 {
+			pemData, err := ioutil.ReadFile(*verifyRoots)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while reading verify-roots: %s\n", err)
+				os.Exit(1)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pemData) {
+				fmt.Fprintf(os.Stderr, "No certificates found in %s\n", *verifyRoots)
+				os.Exit(1)
+			}
+			opts.Roots = pool
+		}
+
+		result, err := bin.Verify(opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Signature verification failed: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signature OK, signed by %q\n", result.SignerCertificate.Subject)
+		if result.Timestamp != nil {
+			fmt.Printf("Counter-signed timestamp: %s\n", result.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
+		}
 		didSomething = true
 	}
 
@@ -0,0 +1,153 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/gesellix/windows-authenticode-cert-tagging/pkg/ber"
+)
+
+// APPX/MSIX packages are ZIP archives whose signature lives in a single
+// entry, AppxSignature.p7x: a 4-byte "PKCX" magic followed by a DER-encoded
+// PKCS#7 ContentInfo. An appended tag, when present, follows that PKCS#7
+// blob within the same entry.
+const appxSignatureEntryName = "AppxSignature.p7x"
+
+var appxSignatureMagic = []byte("PKCX")
+
+type appxBinary struct {
+	contents []byte
+
+	entryDataOffset int // file offset of the start of AppxSignature.p7x's entry content (the "PKCX" magic)
+	entryDataLen    int // length of the entry's content, magic + PKCS#7 blob + any appended tag
+	asn1Len         int // length of just the PKCS#7 blob, starting right after the magic
+}
+
+func newAPPXBinary(contents []byte) (Binary, error) {
+	entry, err := findZipEntry(contents, appxSignatureEntryName)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: not an APPX/MSIX package: %w", err)
+	}
+	if entry.method != zipMethodStored {
+		return nil, errors.New("pkg: AppxSignature.p7x is compressed; only stored entries are supported")
+	}
+	dataOffset, err := zipEntryDataOffset(contents, entry)
+	if err != nil {
+		return nil, err
+	}
+	entryLen := int(entry.compressedSize)
+	if dataOffset+entryLen > len(contents) {
+		return nil, errors.New("pkg: AppxSignature.p7x entry runs past end of file")
+	}
+	entryData := contents[dataOffset : dataOffset+entryLen]
+	if len(entryData) < len(appxSignatureMagic) || string(entryData[:len(appxSignatureMagic)]) != string(appxSignatureMagic) {
+		return nil, errors.New("pkg: AppxSignature.p7x is missing its PKCX magic")
+	}
+
+	asn1Len, err := ber.Len(entryData[len(appxSignatureMagic):])
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to determine PKCS#7 blob length in AppxSignature.p7x: %w", err)
+	}
+
+	return &appxBinary{
+		contents:        contents,
+		entryDataOffset: dataOffset,
+		entryDataLen:    entryLen,
+		asn1Len:         asn1Len,
+	}, nil
+}
+
+func (a *appxBinary) Asn1Data() ([]byte, error) {
+	start := a.entryDataOffset + len(appxSignatureMagic)
+	return a.contents[start : start+a.asn1Len], nil
+}
+
+func (a *appxBinary) CertificateOffset() int {
+	return a.entryDataOffset + len(appxSignatureMagic)
+}
+
+func (a *appxBinary) AppendedTag() ([]byte, bool) {
+	start := a.entryDataOffset + len(appxSignatureMagic) + a.asn1Len
+	end := a.entryDataOffset + a.entryDataLen
+	if start >= end {
+		return nil, false
+	}
+	return a.contents[start:end], true
+}
+
+func (a *appxBinary) RemoveAppendedTag() ([]byte, error) {
+	asn1Data, _ := a.Asn1Data()
+	return a.rewriteEntry(asn1Data, nil)
+}
+
+func (a *appxBinary) SetAppendedTag(tagContents []byte) ([]byte, error) {
+	asn1Data, _ := a.Asn1Data()
+	return a.rewriteEntry(asn1Data, tagContents)
+}
+
+func (a *appxBinary) SetSuperfluousCertTag(tagContents []byte) ([]byte, error) {
+	current, _ := a.Asn1Data()
+	asn1Data, err := setSuperfluousCertTag(current, tagContents)
+	if err != nil {
+		return nil, err
+	}
+	appendedTag, _ := a.AppendedTag()
+	return a.rewriteEntry(asn1Data, appendedTag)
+}
+
+func (a *appxBinary) SetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier, tagContents []byte) ([]byte, error) {
+	current, _ := a.Asn1Data()
+	asn1Data, err := setSuperfluousCertTagByOID(current, oid, tagContents)
+	if err != nil {
+		return nil, err
+	}
+	appendedTag, _ := a.AppendedTag()
+	return a.rewriteEntry(asn1Data, appendedTag)
+}
+
+func (a *appxBinary) GetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier) ([]byte, bool, error) {
+	asn1Data, _ := a.Asn1Data()
+	return getSuperfluousCertTagByOID(asn1Data, oid)
+}
+
+func (a *appxBinary) ListSuperfluousCertTags() ([]OIDTag, error) {
+	asn1Data, _ := a.Asn1Data()
+	return listSuperfluousCertTags(asn1Data)
+}
+
+// rewriteEntry replaces the AppxSignature.p7x entry's content with the
+// PKCX magic, followed by asn1Data, followed by appendedTag, and patches
+// the enclosing ZIP's central directory to match.
+func (a *appxBinary) rewriteEntry(asn1Data, appendedTag []byte) ([]byte, error) {
+	newEntryData := make([]byte, 0, len(appxSignatureMagic)+len(asn1Data)+len(appendedTag))
+	newEntryData = append(newEntryData, appxSignatureMagic...)
+	newEntryData = append(newEntryData, asn1Data...)
+	newEntryData = append(newEntryData, appendedTag...)
+	return zipReplaceEntryData(a.contents, appxSignatureEntryName, newEntryData)
+}
+
+func (a *appxBinary) Verify(opts VerifyOptions) (*VerifyResult, error) {
+	return nil, errors.New("pkg: Authenticode verification of APPX/MSIX packages is not yet implemented")
+}
+
+func (a *appxBinary) Sign(signer crypto.Signer, chain []*x509.Certificate, opts SignOptions) ([]byte, error) {
+	return nil, errors.New("pkg: signing APPX/MSIX packages is not yet implemented")
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// pkcs7BlobForTest returns a real, parseable PKCS#7 SignedData blob, by
+// signing a throwaway PE and pulling its signature back out, suitable for
+// embedding in APPX/CAT test fixtures that otherwise have nothing to do
+// with PE.
+func pkcs7BlobForTest(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	cert := selfSignedCodeSigningCert(t, key)
+	bin, err := NewBinary(buildMinimalPE(t))
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+	signed, err := bin.Sign(key, []*x509.Certificate{cert}, SignOptions{})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	signedBin, err := NewBinary(signed)
+	if err != nil {
+		t.Fatalf("NewBinary on signed output: %v", err)
+	}
+	asn1Data, err := signedBin.Asn1Data()
+	if err != nil {
+		t.Fatalf("Asn1Data: %v", err)
+	}
+	return asn1Data
+}
+
+// buildTestAPPX returns a minimal, stored-entries-only APPX/MSIX ZIP
+// archive with an unrelated entry ahead of a single AppxSignature.p7x entry
+// wrapping asn1Data, so AppxSignature.p7x isn't trivially the first or only
+// entry in the archive.
+//
+// This is assembled by hand, one local/central-directory header pair per
+// file, rather than via archive/zip.Writer: that writer defers the CRC-32
+// and sizes to a trailing data descriptor, which zipReplaceEntryData does
+// not rewrite, instead of writing them into the local file header.
+// assertZIPReadsCleanly checks each entry's CRC-32 against the central
+// directory record; the local file header's copy is not read by
+// archive/zip.
+func buildTestAPPX(t *testing.T, asn1Data []byte) []byte {
+	t.Helper()
+	return buildStoredZIP(t, []storedZIPFile{
+		{name: "AppxManifest.xml", data: []byte("<Package/>")},
+		{name: appxSignatureEntryName, data: append(append([]byte{}, appxSignatureMagic...), asn1Data...)},
+	})
+}
+
+// storedZIPFile is one file to place in a buildStoredZIP archive.
+type storedZIPFile struct {
+	name string
+	data []byte
+}
+
+// buildStoredZIP assembles a minimal, non-ZIP64, all-stored-entries ZIP
+// archive containing files, in order, with real (not data-descriptor)
+// local file headers and a matching central directory.
+func buildStoredZIP(t *testing.T, files []storedZIPFile) []byte {
+	t.Helper()
+
+	type placed struct {
+		storedZIPFile
+		offset int
+		crc    uint32
+	}
+	var out bytes.Buffer
+	var placedFiles []placed
+	for _, f := range files {
+		offset := out.Len()
+		crc := crc32.ChecksumIEEE(f.data)
+
+		hdr := make([]byte, zipLocalFileHeaderSize)
+		binary.LittleEndian.PutUint32(hdr[0:4], zipLocalFileHeaderSig)
+		binary.LittleEndian.PutUint16(hdr[4:6], 20) // version needed to extract
+		binary.LittleEndian.PutUint32(hdr[14:18], crc)
+		binary.LittleEndian.PutUint32(hdr[18:22], uint32(len(f.data)))
+		binary.LittleEndian.PutUint32(hdr[22:26], uint32(len(f.data)))
+		binary.LittleEndian.PutUint16(hdr[26:28], uint16(len(f.name)))
+		out.Write(hdr)
+		out.WriteString(f.name)
+		out.Write(f.data)
+
+		placedFiles = append(placedFiles, placed{f, offset, crc})
+	}
+
+	cdStart := out.Len()
+	for _, f := range placedFiles {
+		hdr := make([]byte, zipCentralDirHeaderSize)
+		binary.LittleEndian.PutUint32(hdr[0:4], zipCentralDirHeaderSig)
+		binary.LittleEndian.PutUint16(hdr[4:6], 20) // version made by
+		binary.LittleEndian.PutUint16(hdr[6:8], 20) // version needed to extract
+		binary.LittleEndian.PutUint32(hdr[16:20], f.crc)
+		binary.LittleEndian.PutUint32(hdr[20:24], uint32(len(f.data)))
+		binary.LittleEndian.PutUint32(hdr[24:28], uint32(len(f.data)))
+		binary.LittleEndian.PutUint16(hdr[28:30], uint16(len(f.name)))
+		binary.LittleEndian.PutUint32(hdr[42:46], uint32(f.offset))
+		out.Write(hdr)
+		out.WriteString(f.name)
+	}
+	cdSize := out.Len() - cdStart
+
+	eocd := make([]byte, zipEndOfCentralDirSize)
+	binary.LittleEndian.PutUint32(eocd[0:4], zipEndOfCentralDirSig)
+	binary.LittleEndian.PutUint16(eocd[8:10], uint16(len(placedFiles)))
+	binary.LittleEndian.PutUint16(eocd[10:12], uint16(len(placedFiles)))
+	binary.LittleEndian.PutUint32(eocd[12:16], uint32(cdSize))
+	binary.LittleEndian.PutUint32(eocd[16:20], uint32(cdStart))
+	out.Write(eocd)
+
+	return out.Bytes()
+}
+
+// assertZIPReadsCleanly reads every entry of contents through the standard
+// library's archive/zip reader, which validates each entry's CRC-32 as it
+// reads — the same check Windows Explorer and Expand-Archive perform, and
+// the one a stale CRC-32 field fails.
+func assertZIPReadsCleanly(t *testing.T, contents []byte) {
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", f.Name, err)
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("reading %s through archive/zip: %v", f.Name, err)
+		}
+	}
+}
+
+func TestAPPXBinary_SetAppendedTag_RoundTrip(t *testing.T) {
+	contents := buildTestAPPX(t, pkcs7BlobForTest(t))
+	bin, err := NewBinary(contents)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	tagContents := []byte("hello, appx tag")
+	tagged, err := bin.SetAppendedTag(tagContents)
+	if err != nil {
+		t.Fatalf("SetAppendedTag: %v", err)
+	}
+	assertZIPReadsCleanly(t, tagged)
+
+	taggedBin, err := NewBinary(tagged)
+	if err != nil {
+		t.Fatalf("NewBinary on tagged output: %v", err)
+	}
+	got, ok := taggedBin.AppendedTag()
+	if !ok || !bytes.Equal(got, tagContents) {
+		t.Errorf("AppendedTag = %q, %v, want %q, true", got, ok, tagContents)
+	}
+}
+
+func TestAPPXBinary_SetSuperfluousCertTagByOID_RoundTrip(t *testing.T) {
+	contents := buildTestAPPX(t, pkcs7BlobForTest(t))
+	bin, err := NewBinary(contents)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 9003}
+	value := bytes.Repeat([]byte{0x7e}, 0x100)
+	tagged, err := bin.SetSuperfluousCertTagByOID(oid, value)
+	if err != nil {
+		t.Fatalf("SetSuperfluousCertTagByOID: %v", err)
+	}
+	assertZIPReadsCleanly(t, tagged)
+
+	taggedBin, err := NewBinary(tagged)
+	if err != nil {
+		t.Fatalf("NewBinary on tagged output: %v", err)
+	}
+	got, ok, err := taggedBin.GetSuperfluousCertTagByOID(oid)
+	if err != nil || !ok {
+		t.Fatalf("GetSuperfluousCertTagByOID = %v, %v, %v", got, ok, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("GetSuperfluousCertTagByOID = %x, want %x", got, value)
+	}
+}
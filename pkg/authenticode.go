@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"crypto"
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// oidSpcIndirectDataContent identifies the encapsulated content signed by
+// an Authenticode SignerInfo: a digest of the PE/MSI image, computed by
+// skipping the regions that the tag tricks in this package rely on not
+// being hashed (the checksum, the Certificate Table directory entry and
+// data, and any appended tag).
+var oidSpcIndirectDataContent = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+
+// spcAttributeTypeAndOptionalValue carries the SpcPeImageData (for PE
+// images) or SpcLink (for MSI installers); its contents don't affect
+// verification so it is kept opaque.
+type spcAttributeTypeAndOptionalValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"optional"`
+}
+
+type digestInfo struct {
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+}
+
+type spcIndirectDataContent struct {
+	Data          spcAttributeTypeAndOptionalValue
+	MessageDigest digestInfo
+}
+
+// digestAlgorithmHashes maps the digest algorithm OIDs that Authenticode
+// signers use onto the corresponding crypto.Hash.
+var digestAlgorithmHashes = map[string]crypto.Hash{
+	"1.2.840.113549.2.5":     crypto.MD5,
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+func hashForAlgorithm(alg pkix.AlgorithmIdentifier) (crypto.Hash, error) {
+	h, ok := digestAlgorithmHashes[alg.Algorithm.String()]
+	if !ok || !h.Available() {
+		return 0, fmt.Errorf("pkg: unsupported Authenticode digest algorithm %s", alg.Algorithm)
+	}
+	return h, nil
+}
+
+// hashRangeAt feeds r's bytes in [start, end) into h, used to build up a PE
+// Authenticode digest from several disjoint byte ranges without ever
+// holding more than one range in memory at a time.
+func hashRangeAt(h hash.Hash, r io.ReaderAt, start, end int64) error {
+	if start >= end {
+		return nil
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(r, start, end-start)); err != nil {
+		return fmt.Errorf("pkg: failed to read image for hashing: %w", err)
+	}
+	return nil
+}
+
+// hashImage computes the Authenticode PE image hash: the whole file, except
+// for the checksum field, the Certificate Table data directory entry, the
+// attribute certificate table itself, and anything appended after it.
+func (p *peBinary) hashImage(h hash.Hash) error {
+	if err := hashRangeAt(h, p.r, 0, int64(p.checkSumOffset)); err != nil {
+		return err
+	}
+	if err := hashRangeAt(h, p.r, int64(p.checkSumOffset+4), int64(p.certEntryOffset)); err != nil {
+		return err
+	}
+	end := p.certDirOffset
+	if end == 0 {
+		end = p.size
+	}
+	return hashRangeAt(h, p.r, int64(p.certEntryOffset+8), end)
+}
+
+// hashImage is the MSI counterpart of peBinary.hashImage. It does not
+// compute the Authenticode MSI digest (every stream in the compound file
+// except "\x05DigitalSignature" and "\x05MsiDigitalSignatureEx", in
+// case-insensitive name order, followed by the CFB header's class ID
+// field); it always returns an error.
+func (m *msiBinary) hashImage(h hash.Hash) error {
+	return fmt.Errorf("pkg: Authenticode verification of MSI installers is not yet implemented")
+}
@@ -0,0 +1,306 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+// Package ber converts BER-encoded ASN.1 data to DER, so that it can be
+// handed to encoding/asn1, which only understands DER (and definite-length,
+// primitively-encoded BER). Some signing toolchains (notably older signtool
+// releases) emit two BER constructions encoding/asn1 rejects outright:
+//
+//   - indefinite-length TLVs, terminated by end-of-contents octets (0x00
+//     0x00) rather than carrying an explicit length; and
+//   - constructed encodings of string types (OCTET STRING, BIT STRING),
+//     where the value is split across several chunks, each itself a TLV of
+//     the same type, rather than being one primitive value.
+//
+// ToDER rewrites both into plain definite-length, primitive DER.
+package ber
+
+import "errors"
+
+// Len returns the number of bytes the first TLV in data (identifier,
+// length and value octets together) occupies, without decoding its
+// contents. It rejects indefinite-length values, since their extent can
+// only be known by scanning for their end-of-contents octets; callers that
+// need to handle those should go through ToDER first.
+func Len(data []byte) (int, error) {
+	tagLen, _, _, _, err := berTag(data)
+	if err != nil {
+		return 0, err
+	}
+	if tagLen >= len(data) {
+		return 0, errors.New("pkg/ber: truncated tag")
+	}
+	if data[tagLen] == 0x80 {
+		return 0, errors.New("pkg/ber: indefinite-length value, call ToDER first")
+	}
+	length, lengthFieldLen, err := berLength(data[tagLen:])
+	if err != nil {
+		return 0, err
+	}
+	total := tagLen + lengthFieldLen + length
+	if total > len(data) {
+		return 0, errors.New("pkg/ber: value runs past end of data")
+	}
+	return total, nil
+}
+
+// ToDER returns data's canonical DER re-encoding. Data that is already DER
+// passes through with the same bytes it started with (aside from the
+// generic re-encoding ToDER always performs), so it is always safe to call.
+func ToDER(data []byte) ([]byte, error) {
+	out, rest, err := normalizeTLV(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("pkg/ber: trailing data after top-level TLV")
+	}
+	return out, nil
+}
+
+// universal class tag numbers that encoding/asn1 expects to be primitive,
+// but which BER permits to be constructed out of same-tagged chunks.
+const (
+	tagBitString   = 3
+	tagOctetString = 4
+)
+
+// normalizeTLV reads a single TLV from data, returning its DER re-encoding
+// and whatever bytes follow it.
+func normalizeTLV(data []byte) (out, rest []byte, err error) {
+	tagLen, tagClass, tagNumber, isConstructed, err := berTag(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tagLen >= len(data) {
+		return nil, nil, errors.New("pkg/ber: truncated tag")
+	}
+	flatten := isConstructed && tagClass == classUniversal && (tagNumber == tagBitString || tagNumber == tagOctetString)
+
+	if data[tagLen] == 0x80 {
+		if !isConstructed {
+			return nil, nil, errors.New("pkg/ber: indefinite length on a primitive value")
+		}
+		value, remaining, err := collectIndefiniteChildren(data[tagLen+1:], flatten)
+		if err != nil {
+			return nil, nil, err
+		}
+		return encodeTLV(data[0], flatten, value), remaining, nil
+	}
+
+	length, lengthFieldLen, err := berLength(data[tagLen:])
+	if err != nil {
+		return nil, nil, err
+	}
+	valueStart := tagLen + lengthFieldLen
+	valueEnd := valueStart + length
+	if valueEnd > len(data) {
+		return nil, nil, errors.New("pkg/ber: value runs past end of data")
+	}
+	value := data[valueStart:valueEnd]
+
+	if isConstructed {
+		if flatten {
+			value, err = flattenChunks(value)
+		} else {
+			value, err = normalizeChildren(value)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return encodeTLV(data[0], flatten, value), data[valueEnd:], nil
+}
+
+// collectIndefiniteChildren reads TLVs from data until it finds the
+// end-of-contents octets (0x00 0x00), returning either their concatenated
+// DER re-encodings (normal case) or, when flatten is set, their
+// concatenated content octets (for reassembling a split string value).
+func collectIndefiniteChildren(data []byte, flatten bool) (value, rest []byte, err error) {
+	var out []byte
+	remaining := data
+	for {
+		if len(remaining) < 2 {
+			return nil, nil, errors.New("pkg/ber: missing end-of-contents octets")
+		}
+		if remaining[0] == 0x00 && remaining[1] == 0x00 {
+			return out, remaining[2:], nil
+		}
+		if flatten {
+			content, childRest, err := chunkContent(remaining)
+			if err != nil {
+				return nil, nil, err
+			}
+			out = append(out, content...)
+			remaining = childRest
+			continue
+		}
+		childOut, childRest, err := normalizeTLV(remaining)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(out, childOut...)
+		remaining = childRest
+	}
+}
+
+// flattenChunks treats value as a sequence of (possibly itself constructed
+// or indefinite-length) same-type TLV chunks and returns their concatenated
+// content octets.
+func flattenChunks(value []byte) ([]byte, error) {
+	var out []byte
+	remaining := value
+	for len(remaining) > 0 {
+		content, rest, err := chunkContent(remaining)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, content...)
+		remaining = rest
+	}
+	return out, nil
+}
+
+// chunkContent returns one chunk's own content octets (recursing through
+// nested constructed/indefinite-length encodings of the same string type),
+// and the bytes following the chunk.
+func chunkContent(data []byte) (content, rest []byte, err error) {
+	tagLen, _, _, isConstructed, err := berTag(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tagLen >= len(data) {
+		return nil, nil, errors.New("pkg/ber: truncated tag")
+	}
+	if data[tagLen] == 0x80 {
+		if !isConstructed {
+			return nil, nil, errors.New("pkg/ber: indefinite length on a primitive value")
+		}
+		return collectIndefiniteChildren(data[tagLen+1:], true)
+	}
+	length, lengthFieldLen, err := berLength(data[tagLen:])
+	if err != nil {
+		return nil, nil, err
+	}
+	valueStart := tagLen + lengthFieldLen
+	valueEnd := valueStart + length
+	if valueEnd > len(data) {
+		return nil, nil, errors.New("pkg/ber: value runs past end of data")
+	}
+	value := data[valueStart:valueEnd]
+	if isConstructed {
+		value, err = flattenChunks(value)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return value, data[valueEnd:], nil
+}
+
+// normalizeChildren re-encodes each TLV found in value (a constructed
+// value's content octets) as DER, concatenating the results.
+func normalizeChildren(value []byte) ([]byte, error) {
+	var out []byte
+	remaining := value
+	for len(remaining) > 0 {
+		childOut, childRest, err := normalizeTLV(remaining)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, childOut...)
+		remaining = childRest
+	}
+	return out, nil
+}
+
+// encodeTLV re-emits a TLV with the original identifier octet (with its
+// constructed bit cleared when flatten is set, since the result is then a
+// single primitive value) and value, in definite-length form.
+func encodeTLV(identifier byte, flatten bool, value []byte) []byte {
+	if flatten {
+		identifier &^= 0x20
+	}
+	out := append([]byte{identifier}, encodeLength(len(value))...)
+	return append(out, value...)
+}
+
+const (
+	classUniversal = 0
+)
+
+// berTag returns the number of bytes occupied by the identifier octet(s)
+// (including any high-tag-number continuation octets), the tag's class and
+// number, and whether the constructed bit is set.
+func berTag(data []byte) (tagLen, class, number int, isConstructed bool, err error) {
+	if len(data) == 0 {
+		return 0, 0, 0, false, errors.New("pkg/ber: empty TLV")
+	}
+	class = int(data[0]&0xc0) >> 6
+	isConstructed = data[0]&0x20 != 0
+	number = int(data[0] & 0x1f)
+	tagLen = 1
+	if number == 0x1f {
+		number = 0
+		for {
+			if tagLen >= len(data) {
+				return 0, 0, 0, false, errors.New("pkg/ber: truncated high tag number")
+			}
+			number = number<<7 | int(data[tagLen]&0x7f)
+			highBitSet := data[tagLen]&0x80 != 0
+			tagLen++
+			if !highBitSet {
+				break
+			}
+		}
+	}
+	return tagLen, class, number, isConstructed, nil
+}
+
+// berLength parses a definite-length field (short or long form) at the
+// start of data and returns the decoded length plus the number of bytes the
+// length field itself occupies.
+func berLength(data []byte) (length, fieldLen int, err error) {
+	if len(data) == 0 {
+		return 0, 0, errors.New("pkg/ber: missing length octet")
+	}
+	b := data[0]
+	if b&0x80 == 0 {
+		return int(b), 1, nil
+	}
+	numBytes := int(b &^ 0x80)
+	if numBytes == 0 {
+		return 0, 0, errors.New("pkg/ber: unexpected indefinite length")
+	}
+	if 1+numBytes > len(data) {
+		return 0, 0, errors.New("pkg/ber: truncated long-form length")
+	}
+	for i := 0; i < numBytes; i++ {
+		length = length<<8 | int(data[1+i])
+	}
+	return length, 1 + numBytes, nil
+}
+
+// encodeLength returns the DER (minimal) length encoding of n.
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var lenBytes []byte
+	for n > 0 {
+		lenBytes = append([]byte{byte(n & 0xff)}, lenBytes...)
+		n >>= 8
+	}
+	return append([]byte{byte(0x80 | len(lenBytes))}, lenBytes...)
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package ber
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"testing"
+)
+
+// TestToDER_ConstructedIndefiniteOctetString exercises the case Authenticode
+// toolchains actually produce: an indefinite-length, constructed OCTET
+// STRING made of two definite-length chunks.
+func TestToDER_ConstructedIndefiniteOctetString(t *testing.T) {
+	ber := []byte{
+		0x24, 0x80, // [UNIVERSAL 4, constructed], indefinite length
+		0x04, 0x03, 'a', 'b', 'c', // chunk 1: OCTET STRING "abc"
+		0x04, 0x02, 'd', 'e', // chunk 2: OCTET STRING "de"
+		0x00, 0x00, // end-of-contents
+	}
+	want := []byte{0x04, 0x05, 'a', 'b', 'c', 'd', 'e'}
+
+	der, err := ToDER(ber)
+	if err != nil {
+		t.Fatalf("ToDER: %v", err)
+	}
+	if !bytes.Equal(der, want) {
+		t.Fatalf("ToDER(%x) = %x, want %x", ber, der, want)
+	}
+
+	var s []byte
+	if _, err := asn1.Unmarshal(der, &s); err != nil {
+		t.Fatalf("encoding/asn1 rejected converted DER: %v", err)
+	}
+	if string(s) != "abcde" {
+		t.Fatalf("unmarshaled OCTET STRING = %q, want %q", s, "abcde")
+	}
+}
+
+// TestToDER_IndefiniteLengthSequence exercises indefinite-length
+// constructed types in general (SignedData itself is one, in the BER this
+// package was written to tolerate).
+func TestToDER_IndefiniteLengthSequence(t *testing.T) {
+	ber := []byte{
+		0x30, 0x80, // SEQUENCE, indefinite length
+		0x02, 0x01, 0x01, // INTEGER 1
+		0x02, 0x01, 0x02, // INTEGER 2
+		0x00, 0x00, // end-of-contents
+	}
+	want := []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x02}
+
+	der, err := ToDER(ber)
+	if err != nil {
+		t.Fatalf("ToDER: %v", err)
+	}
+	if !bytes.Equal(der, want) {
+		t.Fatalf("ToDER(%x) = %x, want %x", ber, der, want)
+	}
+
+	var ints struct{ A, B int }
+	if _, err := asn1.Unmarshal(der, &ints); err != nil {
+		t.Fatalf("encoding/asn1 rejected converted DER: %v", err)
+	}
+	if ints.A != 1 || ints.B != 2 {
+		t.Fatalf("unmarshaled SEQUENCE = %+v, want {1 2}", ints)
+	}
+}
+
+// TestToDER_NestedIndefiniteContent covers a SEQUENCE whose content is
+// itself indefinite-length and which contains an indefinite-length,
+// constructed OCTET STRING field, the combination actually seen wrapping
+// SpcIndirectDataContent's digest in BER-signed Authenticode binaries.
+func TestToDER_NestedIndefiniteContent(t *testing.T) {
+	ber := []byte{
+		0x30, 0x80, // SEQUENCE, indefinite length
+		0x24, 0x80, // OCTET STRING, constructed, indefinite length
+		0x04, 0x02, 0xde, 0xad,
+		0x04, 0x02, 0xbe, 0xef,
+		0x00, 0x00, // end-of-contents for the OCTET STRING
+		0x00, 0x00, // end-of-contents for the SEQUENCE
+	}
+	want := []byte{
+		0x30, 0x06,
+		0x04, 0x04, 0xde, 0xad, 0xbe, 0xef,
+	}
+
+	der, err := ToDER(ber)
+	if err != nil {
+		t.Fatalf("ToDER: %v", err)
+	}
+	if !bytes.Equal(der, want) {
+		t.Fatalf("ToDER(%x) = %x, want %x", ber, der, want)
+	}
+
+	var seq struct {
+		Digest []byte
+	}
+	if _, err := asn1.Unmarshal(der, &seq); err != nil {
+		t.Fatalf("encoding/asn1 rejected converted DER: %v", err)
+	}
+	if !bytes.Equal(seq.Digest, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Fatalf("unmarshaled digest = %x, want deadbeef", seq.Digest)
+	}
+}
+
+// TestToDER_AlreadyDER checks that data already in DER form round-trips
+// unchanged.
+func TestToDER_AlreadyDER(t *testing.T) {
+	der := []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x02}
+	out, err := ToDER(der)
+	if err != nil {
+		t.Fatalf("ToDER: %v", err)
+	}
+	if !bytes.Equal(out, der) {
+		t.Fatalf("ToDER(%x) = %x, want unchanged", der, out)
+	}
+}
+
+// TestToDER_TrailingData rejects extra bytes after the top-level TLV.
+func TestToDER_TrailingData(t *testing.T) {
+	der := []byte{0x02, 0x01, 0x01, 0xff}
+	if _, err := ToDER(der); err == nil {
+		t.Fatal("ToDER accepted trailing data after the top-level TLV")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+// Package pkg implements the parsing, inspection and mutation of
+// Authenticode signatures embedded in Windows PE32/PE32+, MSI, APPX/MSIX
+// and security catalog (.cat) files, and the tagging (and verification) of
+// those files with extra data that survives signature verification.
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+)
+
+// OIDTag is one superfluous-certificate tag found by ListSuperfluousCertTags,
+// identified by the OID of the X.509 extension it was stored in.
+type OIDTag struct {
+	OID     asn1.ObjectIdentifier
+	Payload []byte
+}
+
+// Binary is implemented by each supported container format (PE, MSI,
+// APPX/MSIX, security catalog) and
+// exposes the operations that certificate_tag needs in order to read,
+// rewrite and verify the signature carried by a signed binary.
+type Binary interface {
+	// Asn1Data returns the raw PKCS#7 SignedData blob found in the
+	// binary's certificate table / digital-signature stream. Returns an
+	// error if reading the underlying binary fails.
+	Asn1Data() ([]byte, error)
+
+	// CertificateOffset returns the file offset of the region holding the
+	// PKCS#7 blob. For PE binaries this is the start of the
+	// WIN_CERTIFICATE structure, whose 8-byte header precedes the blob;
+	// for the other formats it is the start of the blob itself.
+	CertificateOffset() int
+
+	// AppendedTag returns any data appended after the PKCS#7 blob, and
+	// whether such data is present.
+	AppendedTag() ([]byte, bool)
+
+	// RemoveAppendedTag returns a copy of the binary with any appended
+	// tag stripped.
+	RemoveAppendedTag() ([]byte, error)
+
+	// SetAppendedTag returns a copy of the binary with the appended tag
+	// set to tagContents.
+	SetAppendedTag(tagContents []byte) ([]byte, error)
+
+	// SetSuperfluousCertTag returns a copy of the binary with a dummy
+	// certificate, carrying tagContents in an X.509 extension, inserted
+	// into the PKCS#7 certificate set. It is equivalent to
+	// SetSuperfluousCertTagByOID with this package's own reserved OID.
+	//
+	// Since this always grows the PKCS#7 blob by one certificate, the MSI
+	// implementation can only succeed as long as the larger blob still
+	// fits in the DigitalSignature stream's existing sectors; see
+	// msiBinary.rewriteSignatureStream.
+	SetSuperfluousCertTag(tagContents []byte) ([]byte, error)
+
+	// SetSuperfluousCertTagByOID is like SetSuperfluousCertTag, but stores
+	// tagContents under a caller-chosen extension OID, so that more than
+	// one superfluous-cert tag can coexist in the same binary.
+	//
+	// Since this always grows the PKCS#7 blob by one certificate, the MSI
+	// implementation can only succeed as long as the larger blob still
+	// fits in the DigitalSignature stream's existing sectors; see
+	// msiBinary.rewriteSignatureStream.
+	SetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier, tagContents []byte) ([]byte, error)
+
+	// GetSuperfluousCertTagByOID searches the binary's current PKCS#7
+	// certificate set for a superfluous-cert tag stored under oid, and
+	// reports whether one was found.
+	GetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier) ([]byte, bool, error)
+
+	// ListSuperfluousCertTags returns every superfluous-cert tag found in
+	// the binary's current PKCS#7 certificate set, regardless of which
+	// extension OID it was stored under.
+	ListSuperfluousCertTags() ([]OIDTag, error)
+
+	// Verify parses and fully verifies the Authenticode signature
+	// carried by the binary, returning details about the signer and any
+	// counter-signature found. See VerifyOptions for the knobs that
+	// control verification.
+	Verify(opts VerifyOptions) (*VerifyResult, error)
+
+	// Sign returns a copy of the binary signed from scratch with signer
+	// and chain (leaf certificate first), replacing any existing
+	// signature. See SignOptions for the knobs that control signing.
+	Sign(signer crypto.Signer, chain []*x509.Certificate, opts SignOptions) ([]byte, error)
+}
+
+var (
+	peMagic  = []byte("MZ")
+	msiMagic = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+	zipMagic = []byte{0x50, 0x4b, 0x03, 0x04}
+)
+
+// NewBinary sniffs contents and returns a Binary implementation suitable
+// for the detected container format, for callers who already have the
+// whole file in memory. Callers reading from an *os.File or similar should
+// use NewBinaryFromReaderAt instead: for PE32/PE32+ binaries, it avoids
+// reading the whole file up front.
+func NewBinary(contents []byte) (Binary, error) {
+	switch {
+	case bytes.HasPrefix(contents, peMagic):
+		return newPEBinary(bytes.NewReader(contents), int64(len(contents)))
+	case bytes.HasPrefix(contents, msiMagic):
+		return newMSIBinary(contents)
+	case bytes.HasPrefix(contents, zipMagic):
+		return newAPPXBinary(contents)
+	default:
+		// Security catalogs (.cat) have no magic of their own; they are
+		// a bare PKCS#7 ContentInfo, so this is tried last.
+		if bin, err := newCATBinary(contents); err == nil {
+			return bin, nil
+		}
+		return nil, errors.New("pkg: unrecognized file format, expected PE32/PE32+, MSI, APPX/MSIX or a security catalog")
+	}
+}
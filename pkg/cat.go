@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+)
+
+// oidCTL identifies a Microsoft Certificate Trust List, the content type
+// carried by a Windows security catalog (.cat) file's bare PKCS#7
+// SignedData.
+var oidCTL = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 1}
+
+// catBinary implements Binary for Windows security catalog (.cat) files: a
+// bare PKCS#7 ContentInfo/SignedData with no enclosing container, so there
+// is no room for an appended tag — only the superfluous-certificate trick
+// applies.
+type catBinary struct {
+	contents []byte
+}
+
+func newCATBinary(contents []byte) (Binary, error) {
+	sd, err := parseSignedData(contents)
+	if err != nil {
+		return nil, err
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidCTL) {
+		return nil, errors.New("pkg: not a security catalog: PKCS#7 content is not a CTL")
+	}
+	return &catBinary{contents: contents}, nil
+}
+
+func (c *catBinary) Asn1Data() ([]byte, error) {
+	return c.contents, nil
+}
+
+func (c *catBinary) CertificateOffset() int {
+	return 0
+}
+
+// Catalog files have no room for an appended tag: the whole file is the
+// PKCS#7 blob, with nothing following it.
+func (c *catBinary) AppendedTag() ([]byte, bool) {
+	return nil, false
+}
+
+func (c *catBinary) RemoveAppendedTag() ([]byte, error) {
+	return nil, errors.New("pkg: security catalogs have no appended tag to remove")
+}
+
+func (c *catBinary) SetAppendedTag(tagContents []byte) ([]byte, error) {
+	return nil, errors.New("pkg: security catalogs do not support appended tags, use a superfluous certificate tag instead")
+}
+
+func (c *catBinary) SetSuperfluousCertTag(tagContents []byte) ([]byte, error) {
+	return setSuperfluousCertTag(c.contents, tagContents)
+}
+
+func (c *catBinary) SetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier, tagContents []byte) ([]byte, error) {
+	return setSuperfluousCertTagByOID(c.contents, oid, tagContents)
+}
+
+func (c *catBinary) GetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier) ([]byte, bool, error) {
+	return getSuperfluousCertTagByOID(c.contents, oid)
+}
+
+func (c *catBinary) ListSuperfluousCertTags() ([]OIDTag, error) {
+	return listSuperfluousCertTags(c.contents)
+}
+
+func (c *catBinary) Verify(opts VerifyOptions) (*VerifyResult, error) {
+	return nil, errors.New("pkg: Authenticode verification of security catalogs is not yet implemented")
+}
+
+func (c *catBinary) Sign(signer crypto.Signer, chain []*x509.Certificate, opts SignOptions) ([]byte, error) {
+	return nil, errors.New("pkg: signing security catalogs is not yet implemented")
+}
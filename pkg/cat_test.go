@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+// buildTestCAT returns a minimal, bare PKCS#7 ContentInfo/SignedData blob
+// whose content type is the CTL OID a security catalog carries: just
+// enough structure for newCATBinary to accept it, reusing this package's
+// own ASN.1 types (cat_test.go is in package pkg) rather than a full,
+// cryptographically valid signature, which catBinary never checks.
+func buildTestCAT(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	cert := selfSignedCodeSigningCert(t, key)
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}}},
+		ContentInfo: contentInfo{
+			ContentType: oidCTL,
+			// An ASN.1 NULL, DER-encoded, standing in for the catalog's
+			// real (and here irrelevant) CTL content: it must be a
+			// validly-framed nested TLV, since ber.ToDER recurses into
+			// this constructed [0] wrapper's contents.
+			Content: asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: []byte{0x05, 0x00}},
+		},
+		Certificates: asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: big.NewInt(1),
+			},
+			DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}},
+			EncryptedDigest:           []byte("not a real signature"),
+		}},
+	}
+	out, err := marshalSignedData(sd)
+	if err != nil {
+		t.Fatalf("marshalSignedData: %v", err)
+	}
+	return out
+}
+
+func TestCATBinary_SetSuperfluousCertTagByOID_RoundTrip(t *testing.T) {
+	contents := buildTestCAT(t)
+	bin, err := NewBinary(contents)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 9003}
+	value := bytes.Repeat([]byte{0x5a}, 0x100)
+	tagged, err := bin.SetSuperfluousCertTagByOID(oid, value)
+	if err != nil {
+		t.Fatalf("SetSuperfluousCertTagByOID: %v", err)
+	}
+
+	taggedBin, err := NewBinary(tagged)
+	if err != nil {
+		t.Fatalf("NewBinary on tagged output: %v", err)
+	}
+	got, ok, err := taggedBin.GetSuperfluousCertTagByOID(oid)
+	if err != nil || !ok {
+		t.Fatalf("GetSuperfluousCertTagByOID = %v, %v, %v", got, ok, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("GetSuperfluousCertTagByOID = %x, want %x", got, value)
+	}
+}
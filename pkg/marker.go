@@ -0,0 +1,68 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// gactMarker prefixes the payload written by SetSuperfluousCertTag so that
+// FindTags can locate it again, in later-tagged copies of the file, without
+// needing to re-parse the PKCS#7 structure.
+var gactMarker = []byte("Gact2.0Omah")
+
+// TagLocation is the file offset and length of one superfluous-cert tag
+// payload, as found by FindTags.
+type TagLocation struct {
+	Offset int
+	Length int
+}
+
+// FindTags searches contents, starting at certOffset (as returned by
+// Binary.CertificateOffset), for every superfluous-cert tag written by
+// SetSuperfluousCertTag or SetSuperfluousCertTagByOID, in the order they
+// appear in the file.
+func FindTags(contents []byte, certOffset int) ([]TagLocation, error) {
+	if certOffset < 0 || certOffset > len(contents) {
+		return nil, errors.New("pkg: certificate offset out of range")
+	}
+
+	var tags []TagLocation
+	pos := certOffset
+	for {
+		idx := bytes.Index(contents[pos:], gactMarker)
+		if idx == -1 {
+			break
+		}
+		lengthOffset := pos + idx + len(gactMarker)
+		if lengthOffset+2 > len(contents) {
+			return nil, errors.New("pkg: truncated superfluous-cert tag length")
+		}
+		tagLen := int(binary.BigEndian.Uint16(contents[lengthOffset : lengthOffset+2]))
+		payloadOffset := lengthOffset + 2
+		if payloadOffset+tagLen > len(contents) {
+			return nil, errors.New("pkg: superfluous-cert tag length exceeds file size")
+		}
+		tags = append(tags, TagLocation{Offset: payloadOffset, Length: tagLen})
+		pos = payloadOffset + tagLen
+	}
+	if len(tags) == 0 {
+		return nil, errors.New("pkg: no superfluous-cert tag found")
+	}
+	return tags, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"testing"
+)
+
+// signedTestBinary returns a freshly-signed minimal PE, used as a base for
+// exercising superfluous-cert tag operations.
+func signedTestBinary(t *testing.T) Binary {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	cert := selfSignedCodeSigningCert(t, key)
+	bin, err := NewBinary(buildMinimalPE(t))
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+	signed, err := bin.Sign(key, []*x509.Certificate{cert}, SignOptions{})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	signedBin, err := NewBinary(signed)
+	if err != nil {
+		t.Fatalf("NewBinary on signed output: %v", err)
+	}
+	return signedBin
+}
+
+// TestSuperfluousCertTag_LastWriteWinsPerOID verifies that, for a binary
+// re-tagged twice under the same OID, GetSuperfluousCertTagByOID returns the
+// most recently set value, and that FindTags reports one location per tag
+// actually present (consistent with there being no single, OID-unaware
+// "the" tag once a binary can carry more than one).
+func TestSuperfluousCertTag_LastWriteWinsPerOID(t *testing.T) {
+	bin := signedTestBinary(t)
+	oidA := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 9001}
+	oidB := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 9002}
+
+	firstValue := bytes.Repeat([]byte{0xaa}, 0x100)
+	contents, err := bin.SetSuperfluousCertTagByOID(oidA, firstValue)
+	if err != nil {
+		t.Fatalf("SetSuperfluousCertTagByOID (first write): %v", err)
+	}
+	bin, err = NewBinary(contents)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	secondValue := bytes.Repeat([]byte{0xbb}, 0x100)
+	contents, err = bin.SetSuperfluousCertTagByOID(oidA, secondValue)
+	if err != nil {
+		t.Fatalf("SetSuperfluousCertTagByOID (second write, same OID): %v", err)
+	}
+	bin, err = NewBinary(contents)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	thirdValue := bytes.Repeat([]byte{0xcc}, 0x100)
+	contents, err = bin.SetSuperfluousCertTagByOID(oidB, thirdValue)
+	if err != nil {
+		t.Fatalf("SetSuperfluousCertTagByOID (different OID): %v", err)
+	}
+	bin, err = NewBinary(contents)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	got, ok, err := bin.GetSuperfluousCertTagByOID(oidA)
+	if err != nil || !ok {
+		t.Fatalf("GetSuperfluousCertTagByOID(oidA) = %v, %v, %v", got, ok, err)
+	}
+	if !bytes.Equal(got, secondValue) {
+		t.Errorf("GetSuperfluousCertTagByOID(oidA) = %x, want the most recently set value %x", got, secondValue)
+	}
+
+	got, ok, err = bin.GetSuperfluousCertTagByOID(oidB)
+	if err != nil || !ok {
+		t.Fatalf("GetSuperfluousCertTagByOID(oidB) = %v, %v, %v", got, ok, err)
+	}
+	if !bytes.Equal(got, thirdValue) {
+		t.Errorf("GetSuperfluousCertTagByOID(oidB) = %x, want %x", got, thirdValue)
+	}
+
+	tags, err := FindTags(contents, bin.CertificateOffset())
+	if err != nil {
+		t.Fatalf("FindTags: %v", err)
+	}
+	if len(tags) != 3 {
+		t.Fatalf("FindTags found %d tags, want 3 (one per SetSuperfluousCertTagByOID call)", len(tags))
+	}
+}
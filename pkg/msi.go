@@ -0,0 +1,281 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// MSI files are OLE/CFB (Compound File Binary) containers. The Authenticode
+// signature lives in a stream named "\x05DigitalSignature". MSI files have
+// no appended-tag region here; they are tagged only through superfluous
+// certificates.
+//
+// This package only reads streams addressed through the regular FAT.
+// Streams smaller than the header's Mini Stream Cutoff Size are required
+// by the CFB format to live in the Mini FAT/mini stream instead, whose
+// sector numbers are addressed completely differently; since
+// DigitalSignature is often only a few KB, newMSIBinary rejects that case
+// explicitly rather than risk silently computing the wrong file offset.
+const (
+	cfbSignature = "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"
+
+	cfbHeaderSize             = 512
+	cfbFreeSector             = 0xFFFFFFFF
+	cfbEndOfChain             = 0xFFFFFFFE
+	cfbDirEntrySize           = 128
+	cfbMiniStreamCutoffOffset = 56 // header offset of the 4-byte Mini Stream Cutoff Size field
+
+	digitalSignatureStreamName = "\x05DigitalSignature"
+)
+
+type cfbDirEntry struct {
+	name      string
+	startSect uint32
+	size      uint64
+	isStream  bool
+}
+
+// msiBinary implements Binary for MSI (OLE/CFB) installer packages.
+type msiBinary struct {
+	contents []byte
+
+	sigStart    int // file offset of the PKCS#7 blob within the DigitalSignature stream
+	sigLength   int // length of the stream, i.e. of the PKCS#7 blob
+	sigCapacity int // bytes available before the stream's last sector ends, >= sigLength
+
+	dirEntrySizeOffset int // file offset of the directory entry's 8-byte stream size field
+}
+
+func newMSIBinary(contents []byte) (Binary, error) {
+	if len(contents) < cfbHeaderSize || string(contents[:8]) != cfbSignature {
+		return nil, errors.New("pkg: missing OLE/CFB signature")
+	}
+
+	sectorShift := binary.LittleEndian.Uint16(contents[30:32])
+	sectorSize := 1 << sectorShift
+
+	fat, err := cfbReadFAT(contents, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+
+	firstDirSector := binary.LittleEndian.Uint32(contents[48:52])
+	dirBytes, err := cfbReadChain(contents, fat, sectorSize, firstDirSector)
+	if err != nil {
+		return nil, err
+	}
+
+	miniStreamCutoff := binary.LittleEndian.Uint32(contents[cfbMiniStreamCutoffOffset : cfbMiniStreamCutoffOffset+4])
+
+	entries := cfbParseDirectory(dirBytes)
+	for i, e := range entries {
+		if e.isStream && e.name == digitalSignatureStreamName {
+			if e.size < uint64(miniStreamCutoff) {
+				return nil, fmt.Errorf("pkg: DigitalSignature stream is %d bytes, below this CFB container's %d-byte Mini Stream Cutoff Size; it is addressed through the Mini FAT, which this package does not support reading", e.size, miniStreamCutoff)
+			}
+			off, err := cfbStreamFileOffset(contents, fat, sectorSize, e)
+			if err != nil {
+				return nil, err
+			}
+			dirEntrySizeOffset, err := cfbChainFileOffset(fat, firstDirSector, sectorSize, i*cfbDirEntrySize+120)
+			if err != nil {
+				return nil, fmt.Errorf("pkg: locating DigitalSignature directory entry: %w", err)
+			}
+			sectorCount := (int(e.size) + sectorSize - 1) / sectorSize
+			return &msiBinary{
+				contents:           contents,
+				sigStart:           off,
+				sigLength:          int(e.size),
+				sigCapacity:        sectorCount * sectorSize,
+				dirEntrySizeOffset: dirEntrySizeOffset,
+			}, nil
+		}
+	}
+	return nil, errors.New("pkg: no \\x05DigitalSignature stream found in MSI")
+}
+
+// cfbChainFileOffset resolves the file offset of logicalOffset bytes into
+// the sector chain starting at start, requiring (like cfbStreamFileOffset)
+// that the chain is contiguous up to that point.
+func cfbChainFileOffset(fat []uint32, start uint32, sectorSize int, logicalOffset int) (int, error) {
+	sect := start
+	for n := logicalOffset / sectorSize; n > 0; n-- {
+		next := fat[sect]
+		if next != sect+1 {
+			return 0, errors.New("pkg: sector chain is fragmented, which this tool does not support")
+		}
+		sect = next
+	}
+	return cfbHeaderSize + int(sect)*sectorSize + logicalOffset%sectorSize, nil
+}
+
+// cfbStreamFileOffset resolves the file offset of a stream's first sector,
+// requiring (for simplicity) that the stream occupies a contiguous run of
+// sectors, which holds true in practice for the small DigitalSignature
+// stream written by signtool.
+func cfbStreamFileOffset(contents []byte, fat []uint32, sectorSize int, e cfbDirEntry) (int, error) {
+	sect := e.startSect
+	prev := sect
+	for i := uint64(0); i*uint64(sectorSize) < e.size; i++ {
+		if i > 0 {
+			next := fat[prev]
+			if next != prev+1 {
+				return 0, errors.New("pkg: DigitalSignature stream is fragmented, which this tool does not support")
+			}
+			prev = next
+		}
+	}
+	return cfbHeaderSize + int(sect)*sectorSize, nil
+}
+
+func cfbReadFAT(contents []byte, sectorSize int) ([]uint32, error) {
+	var fat []uint32
+	for i := 0; i < 109; i++ {
+		entryOffset := 76 + i*4
+		sect := binary.LittleEndian.Uint32(contents[entryOffset : entryOffset+4])
+		if sect == cfbFreeSector {
+			continue
+		}
+		start := cfbHeaderSize + int(sect)*sectorSize
+		if start+sectorSize > len(contents) {
+			return nil, errors.New("pkg: FAT sector out of range")
+		}
+		for o := start; o < start+sectorSize; o += 4 {
+			fat = append(fat, binary.LittleEndian.Uint32(contents[o:o+4]))
+		}
+	}
+	return fat, nil
+}
+
+func cfbReadChain(contents []byte, fat []uint32, sectorSize int, start uint32) ([]byte, error) {
+	var out bytes.Buffer
+	sect := start
+	for sect != cfbEndOfChain && sect != cfbFreeSector {
+		off := cfbHeaderSize + int(sect)*sectorSize
+		if off+sectorSize > len(contents) {
+			return nil, errors.New("pkg: sector chain out of range")
+		}
+		out.Write(contents[off : off+sectorSize])
+		if int(sect) >= len(fat) {
+			return nil, errors.New("pkg: sector chain references unknown FAT entry")
+		}
+		sect = fat[sect]
+	}
+	return out.Bytes(), nil
+}
+
+func cfbParseDirectory(dir []byte) []cfbDirEntry {
+	var entries []cfbDirEntry
+	for off := 0; off+cfbDirEntrySize <= len(dir); off += cfbDirEntrySize {
+		raw := dir[off : off+cfbDirEntrySize]
+		nameLen := int(binary.LittleEndian.Uint16(raw[64:66]))
+		objType := raw[66]
+		if objType == 0 || nameLen < 2 {
+			continue // unused entry
+		}
+		u16 := make([]uint16, (nameLen-2)/2)
+		for i := range u16 {
+			u16[i] = binary.LittleEndian.Uint16(raw[2*i : 2*i+2])
+		}
+		entries = append(entries, cfbDirEntry{
+			name:      string(utf16.Decode(u16)),
+			startSect: binary.LittleEndian.Uint32(raw[116:120]),
+			size:      binary.LittleEndian.Uint64(raw[120:128]),
+			isStream:  objType == 2, // STGTY_STREAM
+		})
+	}
+	return entries
+}
+
+func (m *msiBinary) Asn1Data() ([]byte, error) {
+	if m.sigStart == 0 {
+		return nil, nil
+	}
+	return m.contents[m.sigStart : m.sigStart+m.sigLength], nil
+}
+
+func (m *msiBinary) CertificateOffset() int {
+	return m.sigStart
+}
+
+// MSI files carry no appended-tag region: the only way to tag them is via
+// the superfluous-certificate trick.
+func (m *msiBinary) AppendedTag() ([]byte, bool) {
+	return nil, false
+}
+
+func (m *msiBinary) RemoveAppendedTag() ([]byte, error) {
+	return nil, errors.New("pkg: MSI binaries have no appended tag to remove")
+}
+
+func (m *msiBinary) SetAppendedTag(tagContents []byte) ([]byte, error) {
+	return nil, errors.New("pkg: MSI binaries do not support appended tags, use a superfluous certificate tag instead")
+}
+
+func (m *msiBinary) SetSuperfluousCertTag(tagContents []byte) ([]byte, error) {
+	asn1Data, err := setSuperfluousCertTag(m.contents[m.sigStart:m.sigStart+m.sigLength], tagContents)
+	if err != nil {
+		return nil, err
+	}
+	return m.rewriteSignatureStream(asn1Data)
+}
+
+func (m *msiBinary) SetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier, tagContents []byte) ([]byte, error) {
+	asn1Data, err := setSuperfluousCertTagByOID(m.contents[m.sigStart:m.sigStart+m.sigLength], oid, tagContents)
+	if err != nil {
+		return nil, err
+	}
+	return m.rewriteSignatureStream(asn1Data)
+}
+
+func (m *msiBinary) GetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier) ([]byte, bool, error) {
+	return getSuperfluousCertTagByOID(m.contents[m.sigStart:m.sigStart+m.sigLength], oid)
+}
+
+func (m *msiBinary) ListSuperfluousCertTags() ([]OIDTag, error) {
+	return listSuperfluousCertTags(m.contents[m.sigStart : m.sigStart+m.sigLength])
+}
+
+// rewriteSignatureStream replaces the DigitalSignature stream's content in
+// place with asn1Data and patches the directory entry's size field to
+// match. asn1Data may be shorter or longer than the stream it replaces, as
+// long as it still fits within the stream's existing sector allocation
+// (sigCapacity): MSI streams are made up of whole sectors chained together,
+// and superfluous-cert tagging always grows the PKCS#7 blob by appending a
+// certificate, so there is no slack once sigCapacity is exceeded. Growing
+// past that point would require allocating new sectors and extending the
+// FAT/directory, which this package does not implement; callers hitting
+// that case need a tool that rebuilds the MSI rather than patching it in
+// place.
+func (m *msiBinary) rewriteSignatureStream(asn1Data []byte) ([]byte, error) {
+	if len(asn1Data) > m.sigCapacity {
+		return nil, fmt.Errorf("pkg: new PKCS#7 blob is %d bytes, which no longer fits in the DigitalSignature stream's existing %d-byte sector allocation (was %d bytes); growing an MSI's signature stream across additional sectors is not supported", len(asn1Data), m.sigCapacity, m.sigLength)
+	}
+	out := make([]byte, len(m.contents))
+	copy(out, m.contents)
+	copy(out[m.sigStart:m.sigStart+len(asn1Data)], asn1Data)
+	for i := m.sigStart + len(asn1Data); i < m.sigStart+m.sigCapacity; i++ {
+		out[i] = 0
+	}
+	binary.LittleEndian.PutUint64(out[m.dirEntrySizeOffset:m.dirEntrySizeOffset+8], uint64(len(asn1Data)))
+	return out, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// buildMinimalCFB hand-assembles a minimal OLE/CFB container (sectorShift
+// determines the sector size, 2^sectorShift bytes; a single FAT sector, a
+// single directory sector) holding one stream, digitalSignatureStreamName,
+// occupying contiguous regular sectors starting right after the directory
+// and FAT sectors. The stream's directory entry declares declaredSize
+// bytes (its real, exact byte length: CFB streams carry no padding within
+// their declared size, so anything less would truncate the ASN.1 and
+// anything more would leave trailing garbage for ber.ToDER to reject);
+// only streamData is actually written there, with the rest of the sector
+// allocation zeroed, mirroring an MSI whose DigitalSignature stream has
+// sector-rounding slack for a future re-sign. miniStreamCutoff is written
+// into the header's Mini Stream Cutoff Size field verbatim, so tests can
+// place declaredSize on either side of it.
+func buildMinimalCFB(t *testing.T, streamData []byte, declaredSize int, miniStreamCutoff uint32, sectorShift uint16) []byte {
+	t.Helper()
+
+	sectorSize := 1 << sectorShift
+	// Sector 0: directory. Sector 1: FAT. Sectors 2..: the stream.
+	const dirSector, fatSector, firstStreamSector = 0, 1, 2
+	streamSectors := (declaredSize + sectorSize - 1) / sectorSize
+	if streamSectors == 0 {
+		streamSectors = 1
+	}
+
+	contents := make([]byte, cfbHeaderSize+(2+streamSectors)*sectorSize)
+	copy(contents[0:8], cfbSignature)
+	binary.LittleEndian.PutUint16(contents[30:32], sectorShift)
+	binary.LittleEndian.PutUint32(contents[44:48], 1) // number of FAT sectors
+	binary.LittleEndian.PutUint32(contents[48:52], dirSector)
+	binary.LittleEndian.PutUint32(contents[56:60], miniStreamCutoff)
+	binary.LittleEndian.PutUint32(contents[60:64], cfbEndOfChain) // no Mini FAT
+	binary.LittleEndian.PutUint32(contents[68:72], cfbEndOfChain) // no DIFAT sectors
+	binary.LittleEndian.PutUint32(contents[76:80], fatSector)     // DIFAT[0]
+	for i := 1; i < 109; i++ {
+		binary.LittleEndian.PutUint32(contents[76+i*4:80+i*4], cfbFreeSector)
+	}
+
+	dirOff := cfbHeaderSize + dirSector*sectorSize
+	writeDirEntry(contents[dirOff:dirOff+cfbDirEntrySize], "Root Entry", 5, 0, 0)
+	writeDirEntry(contents[dirOff+cfbDirEntrySize:dirOff+2*cfbDirEntrySize], digitalSignatureStreamName, 2, firstStreamSector, uint64(declaredSize))
+
+	fatOff := cfbHeaderSize + fatSector*sectorSize
+	fat := make([]uint32, sectorSize/4)
+	for i := range fat {
+		fat[i] = cfbFreeSector
+	}
+	fat[dirSector] = cfbEndOfChain
+	fat[fatSector] = cfbEndOfChain
+	for i := 0; i < streamSectors; i++ {
+		if i == streamSectors-1 {
+			fat[firstStreamSector+i] = cfbEndOfChain
+		} else {
+			fat[firstStreamSector+i] = uint32(firstStreamSector + i + 1)
+		}
+	}
+	for i, v := range fat {
+		binary.LittleEndian.PutUint32(contents[fatOff+i*4:fatOff+i*4+4], v)
+	}
+
+	streamOff := cfbHeaderSize + firstStreamSector*sectorSize
+	copy(contents[streamOff:], streamData)
+
+	return contents
+}
+
+// writeDirEntry fills a 128-byte CFB directory entry in place.
+func writeDirEntry(entry []byte, name string, objType byte, startSect uint32, size uint64) {
+	units := utf16.Encode([]rune(name))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(entry[2*i:2*i+2], u)
+	}
+	binary.LittleEndian.PutUint16(entry[64:66], uint16(2*len(units)+2)) // name length, including the null terminator
+	entry[66] = objType
+	binary.LittleEndian.PutUint32(entry[116:120], startSect)
+	binary.LittleEndian.PutUint64(entry[120:128], size)
+}
+
+// TestMSIBinary_RejectsSignatureStreamBelowMiniStreamCutoff confirms that a
+// DigitalSignature stream smaller than the container's Mini Stream Cutoff
+// Size — which the CFB format requires to live in the Mini FAT, addressed
+// completely differently from the regular FAT this package reads — is
+// rejected outright rather than read at a wrong, silently-corrupt offset.
+func TestMSIBinary_RejectsSignatureStreamBelowMiniStreamCutoff(t *testing.T) {
+	contents := buildMinimalCFB(t, bytes.Repeat([]byte{0x42}, 200), 200, 4096, 9)
+
+	_, err := NewBinary(contents)
+	if err == nil {
+		t.Fatal("NewBinary succeeded on a DigitalSignature stream below the Mini Stream Cutoff, want an error")
+	}
+	if !strings.Contains(err.Error(), "Mini") {
+		t.Errorf("NewBinary error = %q, want it to mention the Mini FAT/Mini Stream", err)
+	}
+}
+
+// TestMSIBinary_SetSuperfluousCertTagByOID_RoundTrip exercises the regular
+// (non-Mini-FAT) path against a hand-built CFB container whose Mini Stream
+// Cutoff Size has been set below the real PKCS#7 blob's length, matching a
+// DigitalSignature stream that legitimately lives in the regular FAT. It
+// uses 4096-byte sectors (CFB containers written by modern tooling
+// commonly do) so the stream's sector-rounding slack is enough to absorb
+// the tag's growth in place.
+func TestMSIBinary_SetSuperfluousCertTagByOID_RoundTrip(t *testing.T) {
+	asn1Data := pkcs7BlobForTest(t)
+	contents := buildMinimalCFB(t, asn1Data, len(asn1Data), 64, 12)
+
+	bin, err := NewBinary(contents)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 9003}
+	value := bytes.Repeat([]byte{0x24}, 0x100)
+	tagged, err := bin.SetSuperfluousCertTagByOID(oid, value)
+	if err != nil {
+		t.Fatalf("SetSuperfluousCertTagByOID: %v", err)
+	}
+
+	taggedBin, err := NewBinary(tagged)
+	if err != nil {
+		t.Fatalf("NewBinary on tagged output: %v", err)
+	}
+	got, ok, err := taggedBin.GetSuperfluousCertTagByOID(oid)
+	if err != nil || !ok {
+		t.Fatalf("GetSuperfluousCertTagByOID = %v, %v, %v", got, ok, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("GetSuperfluousCertTagByOID = %x, want %x", got, value)
+	}
+}
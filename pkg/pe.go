@@ -0,0 +1,296 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gesellix/windows-authenticode-cert-tagging/pkg/ber"
+)
+
+// Layout of the fields of IMAGE_OPTIONAL_HEADER{32,64} that this package
+// cares about, measured in bytes from the start of the optional header.
+const (
+	peOptHeaderMagicSize = 2
+	peCheckSumOffset     = 64 // same offset in both PE32 and PE32+
+	peDataDirsOffset32   = 96
+	peDataDirsOffset64   = 112
+
+	pe32Magic     = 0x10b
+	pe32PlusMagic = 0x20b
+
+	// IMAGE_DIRECTORY_ENTRY_SECURITY: the Certificate Table. Unusually
+	// for a data directory, its "VirtualAddress" is a file offset, not
+	// an RVA, because the certificate table lives outside of any
+	// section and is never mapped.
+	certTableDirIndex = 4
+
+	// Certificate Table entries are padded to an 8-byte boundary.
+	certTableAlignment = 8
+)
+
+// peBinary implements Binary for PE32 and PE32+ executables. It holds only
+// an io.ReaderAt and the handful of header offsets newPEBinary parsed out of
+// it, reading further ranges of the file on demand rather than holding the
+// whole image in memory: read-only operations (reading the Certificate
+// Table, finding a superfluous-cert tag) only touch the header and the
+// certificate table itself. Operations that return a rewritten copy of the
+// binary (setting or removing tags, Sign) read everything up to the end of
+// the Certificate Table into that copy. Authenticode's image hash, computed
+// by Sign and Verify, covers nearly the entire file and is read one region
+// at a time.
+type peBinary struct {
+	r    io.ReaderAt
+	size int64
+
+	checkSumOffset  int   // file offset of the COFF checksum field
+	certEntryOffset int   // file offset of the Certificate Table's IMAGE_DATA_DIRECTORY entry
+	certDirOffset   int64 // file offset of the WIN_CERTIFICATE structure (== entry.VirtualAddress), 0 if unsigned
+	certDirSize     int64 // entry.Size, including the WIN_CERTIFICATE header
+}
+
+// readRange reads exactly n bytes at off from r, failing if fewer are
+// available.
+func readRange(r io.ReaderAt, off, n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(io.NewSectionReader(r, off, n), buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func newPEBinary(r io.ReaderAt, size int64) (Binary, error) {
+	if size < 0x40 {
+		return nil, errors.New("pkg: file too small to contain a DOS header")
+	}
+	dosHeader, err := readRange(r, 0, 0x40)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read DOS header: %w", err)
+	}
+	peOffset := int64(binary.LittleEndian.Uint32(dosHeader[0x3c:0x40]))
+	if peOffset < 0 || peOffset+24 > size {
+		return nil, errors.New("pkg: missing PE signature")
+	}
+	peHeader, err := readRange(r, peOffset, 24)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read PE header: %w", err)
+	}
+	if string(peHeader[0:4]) != "PE\x00\x00" {
+		return nil, errors.New("pkg: missing PE signature")
+	}
+
+	optHeaderOffset := peOffset + 24
+	if optHeaderOffset+peOptHeaderMagicSize > size {
+		return nil, errors.New("pkg: truncated optional header")
+	}
+	magicBytes, err := readRange(r, optHeaderOffset, peOptHeaderMagicSize)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read optional header magic: %w", err)
+	}
+	magic := binary.LittleEndian.Uint16(magicBytes)
+
+	var dataDirsOffset int64
+	switch magic {
+	case pe32Magic:
+		dataDirsOffset = optHeaderOffset + peDataDirsOffset32
+	case pe32PlusMagic:
+		dataDirsOffset = optHeaderOffset + peDataDirsOffset64
+	default:
+		return nil, fmt.Errorf("pkg: unrecognized optional header magic %#x", magic)
+	}
+
+	certEntryOffset := dataDirsOffset + certTableDirIndex*8
+	if certEntryOffset+8 > size {
+		return nil, errors.New("pkg: truncated data directories")
+	}
+	entry, err := readRange(r, certEntryOffset, 8)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read Certificate Table entry: %w", err)
+	}
+	certDirOffset := int64(binary.LittleEndian.Uint32(entry[0:4]))
+	certDirSize := int64(binary.LittleEndian.Uint32(entry[4:8]))
+
+	if certDirOffset != 0 {
+		if certDirOffset < 0 || certDirOffset+certDirSize > size || certDirSize < 8 {
+			return nil, errors.New("pkg: certificate table entry out of range")
+		}
+	}
+
+	return &peBinary{
+		r:               r,
+		size:            size,
+		checkSumOffset:  int(optHeaderOffset + peCheckSumOffset),
+		certEntryOffset: int(certEntryOffset),
+		certDirOffset:   certDirOffset,
+		certDirSize:     certDirSize,
+	}, nil
+}
+
+func (p *peBinary) Asn1Data() ([]byte, error) {
+	if p.certDirOffset == 0 || p.certDirSize < 8 {
+		return nil, nil
+	}
+	// The WIN_CERTIFICATE header (DWORD dwLength, WORD wRevision, WORD
+	// wCertificateType) precedes the PKCS#7 blob itself. The data
+	// directory entry's Size covers the whole WIN_CERTIFICATE structure
+	// padded up to certTableAlignment, so the region can run past the
+	// end of the PKCS#7 blob; use the BER/DER length of the blob itself
+	// rather than the padded region so callers (and any round-trip
+	// re-marshaling) don't see trailing padding as part of the ASN.1.
+	padded, err := readRange(p.r, p.certDirOffset+8, p.certDirSize-8)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read Certificate Table: %w", err)
+	}
+	n, err := ber.Len(padded)
+	if err != nil || n > len(padded) {
+		return padded, nil
+	}
+	return padded[:n], nil
+}
+
+func (p *peBinary) CertificateOffset() int {
+	return int(p.certDirOffset)
+}
+
+func (p *peBinary) AppendedTag() ([]byte, bool) {
+	end := p.certDirOffset + p.certDirSize
+	if p.certDirOffset == 0 || end >= p.size {
+		return nil, false
+	}
+	tag, err := readRange(p.r, end, p.size-end)
+	if err != nil {
+		return nil, false
+	}
+	return tag, true
+}
+
+func (p *peBinary) RemoveAppendedTag() ([]byte, error) {
+	end := p.certDirOffset + p.certDirSize
+	if p.certDirOffset == 0 {
+		return nil, errors.New("pkg: binary has no certificate table to trim an appended tag from")
+	}
+	return readRange(p.r, 0, end)
+}
+
+func (p *peBinary) SetAppendedTag(tagContents []byte) ([]byte, error) {
+	if p.certDirOffset == 0 {
+		return nil, errors.New("pkg: binary has no certificate table to append a tag after")
+	}
+	certEnd := p.certDirOffset + p.certDirSize
+	prefix, err := readRange(p.r, 0, certEnd)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read binary up to the Certificate Table: %w", err)
+	}
+	out := make([]byte, 0, int64(len(prefix))+int64(len(tagContents)))
+	out = append(out, prefix...)
+	out = append(out, tagContents...)
+	return out, nil
+}
+
+// rewriteCertTable replaces the PKCS#7 blob with asn1Data (re-wrapping it in
+// a WIN_CERTIFICATE header, padded to certTableAlignment), preserving any
+// appended tag, and patches the Certificate Table data directory entry to
+// match. If the binary has no pre-existing Certificate Table (certDirOffset
+// == 0, i.e. it has never been signed), the new WIN_CERTIFICATE structure is
+// appended to the end of the file instead, and the previously-zeroed data
+// directory entry is patched to point at it.
+func (p *peBinary) rewriteCertTable(asn1Data []byte) ([]byte, error) {
+	appendedTag, hasAppendedTag := p.AppendedTag()
+
+	winCertLen := 8 + len(asn1Data)
+	paddedLen := winCertLen
+	if rem := paddedLen % certTableAlignment; rem != 0 {
+		paddedLen += certTableAlignment - rem
+	}
+
+	certDirStart := p.certDirOffset
+	if certDirStart == 0 {
+		certDirStart = p.size
+	}
+
+	prefix, err := readRange(p.r, 0, certDirStart)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read binary up to the Certificate Table: %w", err)
+	}
+
+	out := make([]byte, 0, int64(len(prefix))+int64(paddedLen)+int64(len(appendedTag)))
+	out = append(out, prefix...)
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(winCertLen))
+	binary.LittleEndian.PutUint16(header[4:6], 0x0200) // WIN_CERT_REVISION_2_0
+	binary.LittleEndian.PutUint16(header[6:8], 0x0002) // WIN_CERT_TYPE_PKCS_SIGNED_DATA
+	out = append(out, header...)
+	out = append(out, asn1Data...)
+	for len(out) < len(prefix)+paddedLen {
+		out = append(out, 0)
+	}
+
+	binary.LittleEndian.PutUint32(out[p.certEntryOffset:p.certEntryOffset+4], uint32(certDirStart))
+	binary.LittleEndian.PutUint32(out[p.certEntryOffset+4:p.certEntryOffset+8], uint32(paddedLen))
+	// The checksum is not covered by the Authenticode hash, but keep it
+	// internally consistent rather than leaving a stale value behind.
+	binary.LittleEndian.PutUint32(out[p.checkSumOffset:p.checkSumOffset+4], 0)
+
+	if hasAppendedTag {
+		out = append(out, appendedTag...)
+	}
+	return out, nil
+}
+
+func (p *peBinary) SetSuperfluousCertTag(tagContents []byte) ([]byte, error) {
+	asn1Data, err := p.Asn1Data()
+	if err != nil {
+		return nil, err
+	}
+	asn1Data, err = setSuperfluousCertTag(asn1Data, tagContents)
+	if err != nil {
+		return nil, err
+	}
+	return p.rewriteCertTable(asn1Data)
+}
+
+func (p *peBinary) SetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier, tagContents []byte) ([]byte, error) {
+	asn1Data, err := p.Asn1Data()
+	if err != nil {
+		return nil, err
+	}
+	asn1Data, err = setSuperfluousCertTagByOID(asn1Data, oid, tagContents)
+	if err != nil {
+		return nil, err
+	}
+	return p.rewriteCertTable(asn1Data)
+}
+
+func (p *peBinary) GetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier) ([]byte, bool, error) {
+	asn1Data, err := p.Asn1Data()
+	if err != nil {
+		return nil, false, err
+	}
+	return getSuperfluousCertTagByOID(asn1Data, oid)
+}
+
+func (p *peBinary) ListSuperfluousCertTags() ([]OIDTag, error) {
+	asn1Data, err := p.Asn1Data()
+	if err != nil {
+		return nil, err
+	}
+	return listSuperfluousCertTags(asn1Data)
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// buildMinimalPE returns the smallest byte sequence newPEBinary will accept:
+// a DOS header whose e_lfanew points directly at the PE signature, a COFF
+// file header (contents irrelevant here), a PE32 optional header with just
+// enough of its data directories present to hold an (initially empty)
+// Certificate Table entry, and a short "body" standing in for the rest of
+// the image.
+func buildMinimalPE(t *testing.T) []byte {
+	t.Helper()
+
+	const (
+		peOffset        = 0x40
+		optHeaderOffset = peOffset + 24
+		dataDirsOffset  = optHeaderOffset + peDataDirsOffset32
+		certEntryOffset = dataDirsOffset + certTableDirIndex*8
+		headerLen       = certEntryOffset + 8
+	)
+
+	contents := make([]byte, headerLen)
+	copy(contents[0:2], []byte("MZ"))
+	copy(contents[0x3c:0x40], []byte{peOffset, 0, 0, 0})
+	copy(contents[peOffset:peOffset+4], []byte("PE\x00\x00"))
+	putUint16(contents[optHeaderOffset:optHeaderOffset+2], pe32Magic)
+	// Certificate Table entry (VirtualAddress, Size) is left zeroed: this
+	// binary has never been signed.
+
+	contents = append(contents, []byte("this is the rest of the image")...)
+	return contents
+}
+
+func putUint16(b []byte, v uint16) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+}
+
+// selfSignedCodeSigningCert generates a fresh self-signed code-signing
+// certificate usable as both the signer and its own trust root, backed by
+// signer.
+func selfSignedCodeSigningCert(t *testing.T, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "certificate_tag test signer"},
+		NotBefore:             time.Unix(1700000000, 0),
+		NotAfter:              time.Unix(1800000000, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		t.Fatalf("failed to create test certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse test certificate: %v", err)
+	}
+	return cert
+}
+
+func verifyOptionsTrusting(cert *x509.Certificate) VerifyOptions {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return VerifyOptions{Roots: roots, CurrentTime: time.Unix(1750000000, 0)}
+}
+
+func testSignVerifyRoundTrip(t *testing.T, signer crypto.Signer) {
+	t.Helper()
+
+	cert := selfSignedCodeSigningCert(t, signer)
+	bin, err := NewBinary(buildMinimalPE(t))
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+
+	signed, err := bin.Sign(signer, []*x509.Certificate{cert}, SignOptions{})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	signedBin, err := NewBinary(signed)
+	if err != nil {
+		t.Fatalf("NewBinary on signed output: %v", err)
+	}
+	result, err := signedBin.Verify(verifyOptionsTrusting(cert))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if result.SignerCertificate.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("Verify returned signer certificate with serial %v, want %v", result.SignerCertificate.SerialNumber, cert.SerialNumber)
+	}
+
+	// Flipping a byte in the image body (not the trailing, 8-byte-aligned
+	// padding after the Certificate Table, which isn't covered by either
+	// the image hash or the signature) must invalidate the signature.
+	tampered := append([]byte{}, signed...)
+	tampered[signedBin.CertificateOffset()-1] ^= 0xff
+	tamperedBin, err := NewBinary(tampered)
+	if err != nil {
+		t.Fatalf("NewBinary on tampered output: %v", err)
+	}
+	if _, err := tamperedBin.Verify(verifyOptionsTrusting(cert)); err == nil {
+		t.Error("Verify succeeded on a tampered image, want an error")
+	}
+}
+
+func TestPEBinary_SignVerifyRoundTrip_RSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	testSignVerifyRoundTrip(t, key)
+}
+
+func TestPEBinary_SignVerifyRoundTrip_ECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	testSignVerifyRoundTrip(t, key)
+}
+
+// TestPEBinary_Sign_FromScratch confirms that a binary with no pre-existing
+// Certificate Table (the common case: a freshly-built, never-signed PE) can
+// still be signed, rather than rewriteCertTable bailing out because there is
+// nothing to rewrite.
+func TestPEBinary_Sign_FromScratch(t *testing.T) {
+	bin, err := NewBinary(buildMinimalPE(t))
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+	if offset := bin.CertificateOffset(); offset != 0 {
+		t.Fatalf("fixture already has a Certificate Table at %d, want 0", offset)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	cert := selfSignedCodeSigningCert(t, key)
+	if _, err := bin.Sign(key, []*x509.Certificate{cert}, SignOptions{}); err != nil {
+		t.Fatalf("Sign on a never-before-signed binary: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/gesellix/windows-authenticode-cert-tagging/pkg/ber"
+)
+
+// The ASN.1 structures below mirror the PKCS#7 ContentInfo/SignedData
+// syntax (RFC 2315) used by Authenticode. Fields we don't need to
+// interpret are kept as asn1.RawValue so that re-marshaling round-trips
+// them byte-for-byte.
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version               int
+	IssuerAndSerialNumber issuerAndSerialNumber
+	DigestAlgorithm       pkix.AlgorithmIdentifier
+	// AuthenticatedAttributes and UnauthenticatedAttributes are kept raw
+	// (rather than decoded straight into []attribute) because the bytes
+	// that get hashed for the signature are these SET's contents with
+	// their tag rewritten from context-specific [0]/[1] to the universal
+	// SET tag; see authenticatedAttributesForHashing.
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// decodeAttributes re-tags raw (a SignerInfo's Authenticated- or
+// UnauthenticatedAttributes) from its context-specific class to the
+// universal SET tag and decodes it as a SET OF Attribute.
+func decodeAttributes(raw asn1.RawValue) ([]attribute, error) {
+	if len(raw.FullBytes) == 0 {
+		return nil, nil
+	}
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(asUniversalSet(raw.FullBytes), &attrs, "set"); err != nil {
+		return nil, fmt.Errorf("pkg: failed to parse attribute set: %w", err)
+	}
+	return attrs, nil
+}
+
+// asUniversalSet rewrites the leading tag octet of a context-specific
+// SET's TLV encoding to the universal, constructed SET tag (0x31), without
+// otherwise touching the length or contents.
+func asUniversalSet(fullBytes []byte) []byte {
+	out := append([]byte{}, fullBytes...)
+	if len(out) > 0 {
+		out[0] = 0x31
+	}
+	return out
+}
+
+var (
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	// oidSuperfluousCertTag identifies the private X.509 extension that
+	// SetSuperfluousCertTag stores its payload in. The arc is unregistered
+	// but scoped under this tool's own reserved prefix, so it will never
+	// collide with a real certificate extension.
+	oidSuperfluousCertTag = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 9001}
+)
+
+// parseSignedData decodes a PKCS#7 ContentInfo wrapping a SignedData. Some
+// signing toolchains (notably older signtool releases) emit BER, not DER,
+// wrapping SpcIndirectDataContent's OCTET STRING in indefinite-length,
+// constructed form, which encoding/asn1 rejects outright; ber.ToDER converts
+// it back to DER first.
+func parseSignedData(asn1Data []byte) (sd signedData, err error) {
+	asn1Data, err = ber.ToDER(asn1Data)
+	if err != nil {
+		return sd, fmt.Errorf("pkg: failed to normalize PKCS#7 BER encoding: %w", err)
+	}
+	var ci contentInfo
+	if _, err = asn1.Unmarshal(asn1Data, &ci); err != nil {
+		return sd, fmt.Errorf("pkg: failed to parse PKCS#7 ContentInfo: %w", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return sd, errors.New("pkg: PKCS#7 ContentInfo does not contain a SignedData")
+	}
+	if _, err = asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return sd, fmt.Errorf("pkg: failed to parse PKCS#7 SignedData: %w", err)
+	}
+	return sd, nil
+}
+
+func marshalSignedData(sd signedData) ([]byte, error) {
+	sdBytes, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to marshal SignedData: %w", err)
+	}
+	ci := contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: sdBytes},
+	}
+	out, err := asn1.Marshal(ci)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to marshal ContentInfo: %w", err)
+	}
+	return out, nil
+}
+
+// setSuperfluousCertTag returns a copy of the PKCS#7 SignedData blob
+// asn1Data with a dummy certificate, carrying tagContents under this
+// package's own reserved OID, appended to its certificate set.
+func setSuperfluousCertTag(asn1Data, tagContents []byte) ([]byte, error) {
+	return setSuperfluousCertTagByOID(asn1Data, oidSuperfluousCertTag, tagContents)
+}
+
+// setSuperfluousCertTagByOID returns a copy of the PKCS#7 SignedData blob
+// asn1Data with a dummy certificate appended to its certificate set. The
+// certificate carries tagContents, behind the Gact2.0 marker, in an X.509
+// extension keyed by oid. Because the certificate set sits outside of the
+// signed content, this never invalidates the Authenticode signature, and
+// because each call adds rather than replaces a certificate, tags under
+// different OIDs (or even repeated calls with the same OID) coexist.
+func setSuperfluousCertTagByOID(asn1Data []byte, oid asn1.ObjectIdentifier, tagContents []byte) ([]byte, error) {
+	sd, err := parseSignedData(asn1Data)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := makeDummyCertificate(oid, tagContents)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to build superfluous certificate: %w", err)
+	}
+
+	certs := append([]byte{}, sd.Certificates.Bytes...)
+	certs = append(certs, cert...)
+	sd.Certificates = asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: certs}
+
+	return marshalSignedData(sd)
+}
+
+// getSuperfluousCertTagByOID searches asn1Data's certificate set for a
+// superfluous-cert tag stored under oid, preferring the most recently
+// added certificate if more than one matches.
+func getSuperfluousCertTagByOID(asn1Data []byte, oid asn1.ObjectIdentifier) ([]byte, bool, error) {
+	tags, err := listSuperfluousCertTags(asn1Data)
+	if err != nil {
+		return nil, false, err
+	}
+	for i := len(tags) - 1; i >= 0; i-- {
+		if tags[i].OID.Equal(oid) {
+			return tags[i].Payload, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// listSuperfluousCertTags returns every superfluous-cert tag found in
+// asn1Data's certificate set, in the order their certificates appear
+// there, regardless of which extension OID each was stored under.
+func listSuperfluousCertTags(asn1Data []byte) ([]OIDTag, error) {
+	sd, err := parseSignedData(asn1Data)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := certificatesFromSet(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to parse certificate set: %w", err)
+	}
+
+	var tags []OIDTag
+	for _, cert := range certs {
+		for _, ext := range cert.Extensions {
+			payload, ok := decodeGactPayload(ext.Value)
+			if ok {
+				tags = append(tags, OIDTag{OID: ext.Id, Payload: payload})
+			}
+		}
+	}
+	return tags, nil
+}
+
+// certificatesFromSet parses the content octets of a PKCS#7 SignedData's
+// "certificates" SET OF Certificate field into individual certificates.
+func certificatesFromSet(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := data
+	for len(rest) > 0 {
+		var raw asn1.RawValue
+		next, err := asn1.Unmarshal(rest, &raw)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+		rest = next
+	}
+	return certs, nil
+}
+
+// decodeGactPayload extracts the payload from an X.509 extension value
+// previously built by makeDummyCertificate, reporting whether extValue
+// actually carries the Gact2.0 marker at all.
+func decodeGactPayload(extValue []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(extValue, gactMarker) {
+		return nil, false
+	}
+	rest := extValue[len(gactMarker):]
+	if len(rest) < 2 {
+		return nil, false
+	}
+	tagLen := int(rest[0])<<8 | int(rest[1])
+	payload := rest[2:]
+	if len(payload) < tagLen {
+		return nil, false
+	}
+	return payload[:tagLen], true
+}
+
+// makeDummyCertificate builds a DER-encoded, self-signed X.509 certificate
+// whose sole purpose is to carry payload, findable again via FindTags or
+// GetSuperfluousCertTagByOID, in an extension keyed by oid.
+func makeDummyCertificate(oid asn1.ObjectIdentifier, payload []byte) ([]byte, error) {
+	tagged := make([]byte, 0, len(gactMarker)+2+len(payload))
+	tagged = append(tagged, gactMarker...)
+	tagged = append(tagged, byte(len(payload)>>8), byte(len(payload)))
+	tagged = append(tagged, payload...)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "certificate_tag superfluous certificate"},
+		NotBefore:    time.Unix(0, 0).UTC(),
+		NotAfter:     time.Unix(0, 0).UTC().AddDate(30, 0, 0),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oid, Value: tagged},
+		},
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// NewBinaryFromReaderAt is the entry point for embedders that already hold
+// an open file (an *os.File, say) rather than a loaded []byte: it saves
+// callers the trouble of reading the whole file themselves before calling
+// NewBinary.
+//
+// For PE32/PE32+ binaries, this reads only the header needed to locate the
+// Certificate Table up front; the full image is read on demand (and, for
+// the image hash computed by Sign/Verify, a range at a time rather than
+// all at once) by the returned Binary. MSI, APPX/MSIX and catalog files are still read into memory in
+// full immediately: their parsers need most or all of the file's bytes
+// anyway (MSI's FAT and directory chains span the whole compound file;
+// APPX/MSIX and catalog parsing both start from a ZIP or PKCS#7 structure
+// that does not expose a cheap way to sniff and seek without materializing
+// it), so there would be little to gain from deferring that read.
+func NewBinaryFromReaderAt(r io.ReaderAt, size int64) (Binary, error) {
+	magic, err := readRange(r, 0, minInt64(size, 8))
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read file header: %w", err)
+	}
+	if bytes.HasPrefix(magic, peMagic) {
+		return newPEBinary(r, size)
+	}
+
+	contents := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(r, 0, size), contents); err != nil {
+		return nil, fmt.Errorf("pkg: failed to read binary: %w", err)
+	}
+	return NewBinary(contents)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
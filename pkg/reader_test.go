@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"io"
+	"testing"
+)
+
+// countingReaderAt wraps an io.ReaderAt and tracks how many bytes were
+// actually read through it, so tests can assert that an operation touched
+// only a small fraction of a large file.
+type countingReaderAt struct {
+	r         io.ReaderAt
+	bytesRead int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.bytesRead += int64(n)
+	return n, err
+}
+
+// largeSignedTaggedPE returns a signed, superfluous-cert-tagged PE whose
+// image body is large enough that reading the whole file, rather than just
+// its header and certificate table, would be obvious in a byte count.
+func largeSignedTaggedPE(t *testing.T) ([]byte, asn1.ObjectIdentifier, []byte) {
+	t.Helper()
+
+	raw := buildMinimalPE(t)
+	raw = append(raw, make([]byte, 1<<20)...) // pad the image body to 1 MiB
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	cert := selfSignedCodeSigningCert(t, key)
+	bin, err := NewBinary(raw)
+	if err != nil {
+		t.Fatalf("NewBinary: %v", err)
+	}
+	signed, err := bin.Sign(key, []*x509.Certificate{cert}, SignOptions{})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	signedBin, err := NewBinary(signed)
+	if err != nil {
+		t.Fatalf("NewBinary on signed output: %v", err)
+	}
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 9003}
+	value := bytes.Repeat([]byte{0x42}, 0x100)
+	tagged, err := signedBin.SetSuperfluousCertTagByOID(oid, value)
+	if err != nil {
+		t.Fatalf("SetSuperfluousCertTagByOID: %v", err)
+	}
+	return tagged, oid, value
+}
+
+// TestNewBinaryFromReaderAt_MetadataOpsAreLazy confirms that reading a
+// superfluous-cert tag back out of a PE via NewBinaryFromReaderAt reads
+// only a small fraction of the file, rather than materializing the whole
+// (here, 1 MiB) image the way NewBinary necessarily must.
+func TestNewBinaryFromReaderAt_MetadataOpsAreLazy(t *testing.T) {
+	contents, oid, value := largeSignedTaggedPE(t)
+
+	cr := &countingReaderAt{r: bytes.NewReader(contents)}
+	bin, err := NewBinaryFromReaderAt(cr, int64(len(contents)))
+	if err != nil {
+		t.Fatalf("NewBinaryFromReaderAt: %v", err)
+	}
+	readAfterOpen := cr.bytesRead
+
+	got, ok, err := bin.GetSuperfluousCertTagByOID(oid)
+	if err != nil || !ok {
+		t.Fatalf("GetSuperfluousCertTagByOID = %v, %v, %v", got, ok, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("GetSuperfluousCertTagByOID = %x, want %x", got, value)
+	}
+
+	if cr.bytesRead >= int64(len(contents))/2 {
+		t.Errorf("NewBinaryFromReaderAt + GetSuperfluousCertTagByOID read %d of %d bytes (%d just to open); want it to stay near the certificate table, not read the whole image", cr.bytesRead, len(contents), readAfterOpen)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/gesellix/windows-authenticode-cert-tagging/pkg/sign"
+)
+
+// SignOptions controls the optional parts of a fresh Authenticode
+// signature produced by Binary.Sign.
+type SignOptions struct {
+	// HashAlgorithm is the digest algorithm used both for the image
+	// digest and for signing. Defaults to crypto.SHA256.
+	HashAlgorithm crypto.Hash
+
+	// ProgramName and MoreInfoURL, if either is set, are embedded in the
+	// signature's SpcSpOpusInfo attribute.
+	ProgramName string
+	MoreInfoURL string
+
+	// TimestampURL, if set, is queried for an RFC 3161 timestamp over
+	// the signature, embedded as a SignerInfo counter-signature.
+	TimestampURL string
+}
+
+func (o SignOptions) toPkgSignOptions() sign.Options {
+	return sign.Options{
+		HashAlgorithm: o.HashAlgorithm,
+		ProgramName:   o.ProgramName,
+		MoreInfoURL:   o.MoreInfoURL,
+		TimestampURL:  o.TimestampURL,
+	}
+}
+
+// Sign implements Binary.
+func (p *peBinary) Sign(signer crypto.Signer, chain []*x509.Certificate, opts SignOptions) ([]byte, error) {
+	h := opts.HashAlgorithm
+	if h == 0 {
+		h = crypto.SHA256
+	}
+	digest := h.New()
+	if err := p.hashImage(digest); err != nil {
+		return nil, err
+	}
+
+	asn1Data, err := sign.SignedData(digest.Sum(nil), sign.ContentTypePE, signer, chain, opts.toPkgSignOptions())
+	if err != nil {
+		return nil, err
+	}
+	return p.rewriteCertTable(asn1Data)
+}
+
+// Sign implements Binary. MSI installer signing is not yet supported: it
+// requires rewriting the "\x05DigitalSignature" stream in a way that may
+// change the compound file's overall sector layout, which this package
+// does not yet do.
+func (m *msiBinary) Sign(signer crypto.Signer, chain []*x509.Certificate, opts SignOptions) ([]byte, error) {
+	return nil, fmt.Errorf("pkg: signing MSI installers is not yet implemented")
+}
@@ -0,0 +1,373 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+// Package sign builds Authenticode PKCS#7 SignedData blobs from scratch:
+// given a pre-computed PE or MSI image digest and a signing key/certificate
+// chain, it produces the DER bytes that a Binary implementation in pkg can
+// embed in a (possibly new) security directory or digital-signature stream.
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"unicode/utf16"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ContentType selects which SpcAttributeTypeAndOptionalValue is embedded in
+// the SpcIndirectDataContent, matching the container being signed.
+type ContentType int
+
+const (
+	// ContentTypePE marks the signed content as an SpcPeImageData, used
+	// for PE32/PE32+ executables.
+	ContentTypePE ContentType = iota
+	// ContentTypeMSI marks the signed content as an SpcLink, used for
+	// MSI installers.
+	ContentTypeMSI
+)
+
+// Options controls the optional parts of the SignedData that SignedData
+// builds.
+type Options struct {
+	// HashAlgorithm is the digest algorithm used both for the image
+	// digest and for signing. Defaults to crypto.SHA256.
+	HashAlgorithm crypto.Hash
+
+	// ProgramName and MoreInfoURL, if either is set, are embedded in an
+	// SpcSpOpusInfo authenticated attribute.
+	ProgramName string
+	MoreInfoURL string
+
+	// TimestampURL, if set, is queried for an RFC 3161 timestamp over
+	// the signature, which is embedded as an unauthenticated attribute.
+	TimestampURL string
+}
+
+func (o Options) hashAlgorithm() crypto.Hash {
+	if o.HashAlgorithm == 0 {
+		return crypto.SHA256
+	}
+	return o.HashAlgorithm
+}
+
+var (
+	oidSpcIndirectDataContent = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcPEImageData         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidSpcLink                = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 25}
+	oidSpcSpOpusInfo          = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidSpcStatementType       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 11}
+	oidIndividualCodeSigning  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 21}
+
+	oidContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSignedData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidRSAEncryption    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRFC3161Timestamp = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+
+	digestAlgorithmOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+		crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+		crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+		crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+	}
+
+	// ecdsaWithSHAxxx (RFC 5758), keyed by the hash algorithm used to
+	// produce the signature.
+	ecdsaSignatureOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA1:   {1, 2, 840, 10045, 4, 1},
+		crypto.SHA256: {1, 2, 840, 10045, 4, 3, 2},
+		crypto.SHA384: {1, 2, 840, 10045, 4, 3, 3},
+		crypto.SHA512: {1, 2, 840, 10045, 4, 3, 4},
+	}
+)
+
+// digestEncryptionAlgorithm picks the DigestEncryptionAlgorithm OID for a
+// SignerInfo, based on the actual type of the signer's public key. This
+// must match the key type, since Authenticode and PKCS#7 verifiers use it
+// to decide how to interpret EncryptedDigest.
+func digestEncryptionAlgorithm(pub crypto.PublicKey, hashAlg crypto.Hash) (asn1.ObjectIdentifier, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return oidRSAEncryption, nil
+	case *ecdsa.PublicKey:
+		oid, ok := ecdsaSignatureOIDs[hashAlg]
+		if !ok {
+			return nil, fmt.Errorf("sign: no ecdsa-with-* OID for hash algorithm %v", hashAlg)
+		}
+		return oid, nil
+	default:
+		return nil, fmt.Errorf("sign: unsupported signer public key type %T", pub)
+	}
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type spcAttributeTypeAndOptionalValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"optional"`
+}
+
+type digestInfo struct {
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+}
+
+type spcIndirectDataContent struct {
+	Data          spcAttributeTypeAndOptionalValue
+	MessageDigest digestInfo
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   []attribute `asn1:"optional,tag:0,set"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes []attribute `asn1:"optional,tag:1"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+// SignedData builds a complete Authenticode PKCS#7 ContentInfo, wrapping a
+// SignedData over an SpcIndirectDataContent whose MessageDigest is
+// imageDigest, signed by signer (whose leaf certificate must be chain[0]).
+func SignedData(imageDigest []byte, contentType ContentType, signer crypto.Signer, chain []*x509.Certificate, opts Options) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("sign: certificate chain is empty")
+	}
+	hashAlg := opts.hashAlgorithm()
+	digestOID, ok := digestAlgorithmOIDs[hashAlg]
+	if !ok {
+		return nil, fmt.Errorf("sign: unsupported hash algorithm %v", hashAlg)
+	}
+	digestAlgID := pkix.AlgorithmIdentifier{Algorithm: digestOID}
+
+	spcOID := oidSpcPEImageData
+	if contentType == ContentTypeMSI {
+		spcOID = oidSpcLink
+	}
+	indirectData := spcIndirectDataContent{
+		Data:          spcAttributeTypeAndOptionalValue{Type: spcOID},
+		MessageDigest: digestInfo{DigestAlgorithm: digestAlgID, Digest: imageDigest},
+	}
+	eContent, err := asn1.Marshal(indirectData)
+	if err != nil {
+		return nil, fmt.Errorf("sign: failed to marshal SpcIndirectDataContent: %w", err)
+	}
+
+	eContentDigest := hashAlg.New()
+	eContentDigest.Write(eContent)
+
+	authAttrs := []attribute{
+		{Type: oidContentType, Value: mustSetOf(oidSpcIndirectDataContent)},
+		{Type: oidMessageDigest, Value: mustSetOf(eContentDigest.Sum(nil))},
+	}
+	if opts.ProgramName != "" || opts.MoreInfoURL != "" {
+		opusInfo, err := spcSpOpusInfoAttribute(opts.ProgramName, opts.MoreInfoURL)
+		if err != nil {
+			return nil, fmt.Errorf("sign: failed to marshal SpcSpOpusInfo: %w", err)
+		}
+		authAttrs = append(authAttrs,
+			attribute{Type: oidSpcStatementType, Value: mustSetOf([]asn1.ObjectIdentifier{oidIndividualCodeSigning})},
+			opusInfo,
+		)
+	}
+
+	toSign, err := asn1.MarshalWithParams(authAttrs, "set")
+	if err != nil {
+		return nil, fmt.Errorf("sign: failed to marshal authenticated attributes: %w", err)
+	}
+
+	hashed := hashAlg.New()
+	hashed.Write(toSign)
+	signature, err := signer.Sign(rand.Reader, hashed.Sum(nil), hashAlg)
+	if err != nil {
+		return nil, fmt.Errorf("sign: failed to sign authenticated attributes: %w", err)
+	}
+
+	leaf := chain[0]
+	encOID, err := digestEncryptionAlgorithm(leaf.PublicKey, hashAlg)
+	if err != nil {
+		return nil, err
+	}
+	si := signerInfo{
+		Version: 1,
+		IssuerAndSerialNumber: issuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: leaf.RawIssuer},
+			SerialNumber: leaf.SerialNumber,
+		},
+		DigestAlgorithm:           digestAlgID,
+		AuthenticatedAttributes:   authAttrs,
+		DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: encOID},
+		EncryptedDigest:           signature,
+	}
+
+	if opts.TimestampURL != "" {
+		token, err := fetchTimestamp(opts.TimestampURL, signature, hashAlg)
+		if err != nil {
+			return nil, fmt.Errorf("sign: failed to fetch RFC 3161 timestamp: %w", err)
+		}
+		si.UnauthenticatedAttributes = []attribute{
+			{Type: oidRFC3161Timestamp, Value: mustSetOfRaw(token)},
+		}
+	}
+
+	var certsDER []byte
+	for _, c := range chain {
+		certsDER = append(certsDER, c.Raw...)
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgID},
+		ContentInfo: contentInfo{
+			ContentType: oidSpcIndirectDataContent,
+			Content:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: eContent},
+		},
+		Certificates: asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: certsDER},
+		SignerInfos:  []signerInfo{si},
+	}
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("sign: failed to marshal SignedData: %w", err)
+	}
+	ci := contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: sdDER},
+	}
+	return asn1.Marshal(ci)
+}
+
+// mustSetOf marshals value and wraps it as the sole member of a universal
+// SET, which is how PKCS#7 attribute values are encoded.
+func mustSetOf(value interface{}) asn1.RawValue {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		panic(err) // value is always one of this file's own fixed types
+	}
+	return asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: der}
+}
+
+// mustSetOfRaw is mustSetOf for a value that is already DER-encoded.
+func mustSetOfRaw(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: der}
+}
+
+// spcSpOpusInfoAttribute builds the SpcSpOpusInfo authenticated attribute,
+// Authenticode's vendor extension carrying the program name and more-info
+// URL shown in Windows' signature UI:
+//
+//	SpcSpOpusInfo ::= SEQUENCE {
+//	    programName  [0] EXPLICIT SpcString OPTIONAL,
+//	    moreInfo     [1] EXPLICIT SpcLink OPTIONAL
+//	}
+//	SpcString ::= CHOICE {
+//	    unicode  [0] IMPLICIT BMPString,
+//	    ascii    [1] IMPLICIT IA5String
+//	}
+//	SpcLink ::= CHOICE {
+//	    url      [0] IMPLICIT IA5String,
+//	    ...
+//	}
+//
+// encoding/asn1 has no support for CHOICE, so both CHOICEs used here (a
+// unicode program name, a URL more-info link, matching what signtool
+// produces) are built by hand as asn1.RawValues.
+func spcSpOpusInfoAttribute(programName, moreInfoURL string) (attribute, error) {
+	var body []byte
+	if programName != "" {
+		field, err := explicitlyTagged(0, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: utf16BEBytes(programName)})
+		if err != nil {
+			return attribute{}, err
+		}
+		body = append(body, field...)
+	}
+	if moreInfoURL != "" {
+		field, err := explicitlyTagged(1, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte(moreInfoURL)})
+		if err != nil {
+			return attribute{}, err
+		}
+		body = append(body, field...)
+	}
+	seq, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: body})
+	if err != nil {
+		return attribute{}, err
+	}
+	return attribute{Type: oidSpcSpOpusInfo, Value: mustSetOfRaw(seq)}, nil
+}
+
+// explicitlyTagged DER-encodes inner, then wraps the result in an
+// EXPLICIT context-specific tag.
+func explicitlyTagged(tag int, inner asn1.RawValue) ([]byte, error) {
+	der, err := asn1.Marshal(inner)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der})
+}
+
+// utf16BEBytes encodes s as UTF-16BE, the wire format of a BMPString.
+func utf16BEBytes(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(buf[2*i:], u)
+	}
+	return buf
+}
+
+// LoadPKCS12 parses a PKCS#12 (.pfx) file and returns the private key and
+// the certificate chain (leaf first) it contains.
+func LoadPKCS12(data []byte, password string) (crypto.Signer, []*x509.Certificate, error) {
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sign: failed to decode PKCS#12: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("sign: PKCS#12 private key of type %T does not implement crypto.Signer", key)
+	}
+	return signer, append([]*x509.Certificate{leaf}, chain...), nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package sign
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func selfSignedCodeSigningCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sign test signer"},
+		NotBefore:             time.Unix(1700000000, 0),
+		NotAfter:              time.Unix(1800000000, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return key, cert
+}
+
+// TestSignedData_EmbedsSpcSpOpusInfo confirms that setting
+// Options.ProgramName/MoreInfoURL actually lands those values in the
+// output, rather than being silently dropped.
+func TestSignedData_EmbedsSpcSpOpusInfo(t *testing.T) {
+	key, cert := selfSignedCodeSigningCert(t)
+
+	der, err := SignedData([]byte("0123456789abcdef0123456789abcdef"), ContentTypePE, key, []*x509.Certificate{cert}, Options{
+		ProgramName: "My Program",
+		MoreInfoURL: "https://example.com/my-program",
+	})
+	if err != nil {
+		t.Fatalf("SignedData: %v", err)
+	}
+
+	if !bytes.Contains(der, utf16BEBytes("My Program")) {
+		t.Error("SignedData output does not contain the UTF-16BE-encoded ProgramName")
+	}
+	if !bytes.Contains(der, []byte("https://example.com/my-program")) {
+		t.Error("SignedData output does not contain MoreInfoURL")
+	}
+}
+
+// TestSignedData_OmitsSpcSpOpusInfoWhenUnset confirms that leaving both
+// fields unset doesn't emit an SpcSpOpusInfo attribute at all.
+func TestSignedData_OmitsSpcSpOpusInfoWhenUnset(t *testing.T) {
+	key, cert := selfSignedCodeSigningCert(t)
+
+	der, err := SignedData([]byte("0123456789abcdef0123456789abcdef"), ContentTypePE, key, []*x509.Certificate{cert}, Options{})
+	if err != nil {
+		t.Fatalf("SignedData: %v", err)
+	}
+
+	oidDER, err := asn1.Marshal(oidSpcSpOpusInfo)
+	if err != nil {
+		t.Fatalf("Marshal oidSpcSpOpusInfo: %v", err)
+	}
+	if bytes.Contains(der, oidDER) {
+		t.Error("SignedData output contains the SpcSpOpusInfo OID despite ProgramName/MoreInfoURL being unset")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+)
+
+const timestampQueryContentType = "application/timestamp-query"
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// fetchTimestamp requests an RFC 3161 timestamp over signature's hash from
+// the TSA at url, and returns the raw ContentInfo (a PKCS#7 SignedData)
+// that constitutes the timestamp token.
+func fetchTimestamp(url string, signature []byte, hashAlg crypto.Hash) ([]byte, error) {
+	digestOID, ok := digestAlgorithmOIDs[hashAlg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %v", hashAlg)
+	}
+	h := hashAlg.New()
+	h.Write(signature)
+
+	nonce, err := rand.Int(rand.Reader, big.NewInt(0).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	req := timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: digestOID},
+			HashedMessage: h.Sum(nil),
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	}
+	reqDER, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal TimeStampReq: %w", err)
+	}
+
+	httpResp, err := http.Post(url, timestampQueryContentType, bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, fmt.Errorf("TSA request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TSA response: %w", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("TSA returned HTTP %d", httpResp.StatusCode)
+	}
+
+	var resp timeStampResp
+	if _, err := asn1.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse TimeStampResp: %w", err)
+	}
+	if resp.Status.Status != 0 && resp.Status.Status != 1 {
+		return nil, fmt.Errorf("TSA rejected request: status %d", resp.Status.Status)
+	}
+	if len(resp.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("TSA response carried no timestamp token")
+	}
+	return resp.TimeStampToken.FullBytes, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"fmt"
+	"io"
+)
+
+// Tagger is the stable, embeddable API for reading and rewriting the tags
+// that certificate_tag manages, wrapping whichever Binary implementation
+// matches the underlying file. It exists so that programs embedding this
+// package have a single, narrow type to depend on instead of reaching
+// into Binary and the package-level FindTags directly, as the command-line
+// tool does.
+type Tagger struct {
+	bin  Binary
+	r    io.ReaderAt
+	size int64
+}
+
+// NewTagger wraps contents in a Tagger, sniffing its container format.
+func NewTagger(contents []byte) (*Tagger, error) {
+	bin, err := NewBinary(contents)
+	if err != nil {
+		return nil, err
+	}
+	return &Tagger{bin: bin, r: bytes.NewReader(contents), size: int64(len(contents))}, nil
+}
+
+// NewTaggerFromReaderAt is the io.ReaderAt counterpart of NewTagger.
+func NewTaggerFromReaderAt(r io.ReaderAt, size int64) (*Tagger, error) {
+	bin, err := NewBinaryFromReaderAt(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Tagger{bin: bin, r: r, size: size}, nil
+}
+
+// Dump returns any appended tag present in the wrapped binary, and whether
+// one was found. See Binary.AppendedTag.
+func (t *Tagger) Dump() ([]byte, bool) {
+	return t.bin.AppendedTag()
+}
+
+// Set returns a copy of the binary with its appended tag set to
+// tagContents. See Binary.SetAppendedTag.
+func (t *Tagger) Set(tagContents []byte) ([]byte, error) {
+	return t.bin.SetAppendedTag(tagContents)
+}
+
+// Remove returns a copy of the binary with any appended tag stripped. See
+// Binary.RemoveAppendedTag.
+func (t *Tagger) Remove() ([]byte, error) {
+	return t.bin.RemoveAppendedTag()
+}
+
+// SetSuperfluousCertTag returns a copy of the binary with a superfluous
+// certificate tag set to tagContents. See Binary.SetSuperfluousCertTag.
+func (t *Tagger) SetSuperfluousCertTag(tagContents []byte) ([]byte, error) {
+	return t.bin.SetSuperfluousCertTag(tagContents)
+}
+
+// SetSuperfluousCertTagByOID returns a copy of the binary with a
+// superfluous certificate tag set to tagContents under oid. See
+// Binary.SetSuperfluousCertTagByOID.
+func (t *Tagger) SetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier, tagContents []byte) ([]byte, error) {
+	return t.bin.SetSuperfluousCertTagByOID(oid, tagContents)
+}
+
+// GetSuperfluousCertTagByOID looks up a superfluous-cert tag by oid. See
+// Binary.GetSuperfluousCertTagByOID.
+func (t *Tagger) GetSuperfluousCertTagByOID(oid asn1.ObjectIdentifier) ([]byte, bool, error) {
+	return t.bin.GetSuperfluousCertTagByOID(oid)
+}
+
+// ListSuperfluousCertTags lists every superfluous-cert tag present. See
+// Binary.ListSuperfluousCertTags.
+func (t *Tagger) ListSuperfluousCertTags() ([]OIDTag, error) {
+	return t.bin.ListSuperfluousCertTags()
+}
+
+// Verify fully verifies the binary's Authenticode signature. See
+// Binary.Verify.
+func (t *Tagger) Verify(opts VerifyOptions) (*VerifyResult, error) {
+	return t.bin.Verify(opts)
+}
+
+// FindTags searches for every superfluous-cert tag present, reading only
+// the region from the binary's certificate table to the end of the file
+// (where SetSuperfluousCertTag and SetSuperfluousCertTagByOID always write
+// theirs) rather than the whole file. See the package-level FindTags.
+func (t *Tagger) FindTags() ([]TagLocation, error) {
+	certOffset := int64(t.bin.CertificateOffset())
+	tail, err := readRange(t.r, certOffset, t.size-certOffset)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to read tag region: %w", err)
+	}
+	tags, err := FindTags(tail, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tags {
+		tags[i].Offset += int(certOffset)
+	}
+	return tags, nil
+}
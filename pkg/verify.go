@@ -0,0 +1,268 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// VerifyOptions controls how Binary.Verify chains the signer's certificate.
+type VerifyOptions struct {
+	// Roots is the set of trust anchors to chain the signer's
+	// certificate to. A nil pool means "use the host's default roots",
+	// matching crypto/x509.VerifyOptions.
+	Roots *x509.CertPool
+
+	// CurrentTime overrides the time used to check certificate validity
+	// periods. The zero value means "now".
+	CurrentTime time.Time
+}
+
+// VerifyResult describes a successfully verified Authenticode signature.
+type VerifyResult struct {
+	// SignerCertificate is the leaf certificate that produced the
+	// signature.
+	SignerCertificate *x509.Certificate
+
+	// Chains are the certificate chains, rooted in opts.Roots, that
+	// SignerCertificate was successfully verified against.
+	Chains [][]*x509.Certificate
+
+	// Timestamp is the time asserted by an RFC 3161 counter-signature
+	// found in the SignerInfo's unauthenticated attributes, if any.
+	Timestamp *time.Time
+}
+
+var (
+	oidMessageDigest      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRFC3161Timestamp   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+	oidPKCS9CounterSigner = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 6}
+)
+
+// Verify implements Binary.
+func (p *peBinary) Verify(opts VerifyOptions) (*VerifyResult, error) {
+	asn1Data, err := p.Asn1Data()
+	if err != nil {
+		return nil, err
+	}
+	return verifyAuthenticode(asn1Data, func(ch crypto.Hash) ([]byte, error) {
+		h := ch.New()
+		if err := p.hashImage(h); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}, opts)
+}
+
+// Verify implements Binary.
+func (m *msiBinary) Verify(opts VerifyOptions) (*VerifyResult, error) {
+	return nil, fmt.Errorf("pkg: %w", errMSIVerifyUnimplemented)
+}
+
+var errMSIVerifyUnimplemented = fmt.Errorf("MSI Authenticode verification is not yet implemented")
+
+// verifyAuthenticode performs full PKCS#7 SignedData verification of an
+// Authenticode signature: it re-hashes the image via hashImage, checks that
+// digest against the one carried in the SpcIndirectDataContent, and then
+// verifies the SignerInfo's signature over the authenticated attributes up
+// to a trusted root.
+func verifyAuthenticode(asn1Data []byte, hashImage func(h crypto.Hash) ([]byte, error), opts VerifyOptions) (*VerifyResult, error) {
+	sd, err := parseSignedData(asn1Data)
+	if err != nil {
+		return nil, err
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectDataContent) {
+		return nil, fmt.Errorf("pkg: signed content is not SpcIndirectDataContent (got %s)", sd.ContentInfo.ContentType)
+	}
+	var indirectData spcIndirectDataContent
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &indirectData); err != nil {
+		return nil, fmt.Errorf("pkg: failed to parse SpcIndirectDataContent: %w", err)
+	}
+
+	contentHash, err := hashForAlgorithm(indirectData.MessageDigest.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	actualDigest, err := hashImage(contentHash)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(actualDigest, indirectData.MessageDigest.Digest) {
+		return nil, fmt.Errorf("pkg: Authenticode image hash mismatch: signature covers a different file")
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("pkg: expected exactly one SignerInfo, found %d", len(sd.SignerInfos))
+	}
+	signer := sd.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to parse certificate set: %w", err)
+	}
+	signerCert := findCertificate(certs, signer.IssuerAndSerialNumber.SerialNumber)
+	if signerCert == nil {
+		return nil, fmt.Errorf("pkg: no certificate in the PKCS#7 certificate set matches the SignerInfo")
+	}
+
+	digestHash, err := hashForAlgorithm(signer.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	authAttrs, err := decodeAttributes(signer.AuthenticatedAttributes)
+	if err != nil {
+		return nil, err
+	}
+	if authAttrs == nil {
+		return nil, fmt.Errorf("pkg: SignerInfo has no authenticated attributes")
+	}
+	messageDigestAttr, ok := findAttribute(authAttrs, oidMessageDigest)
+	if !ok {
+		return nil, fmt.Errorf("pkg: authenticated attributes are missing messageDigest")
+	}
+	var attrDigest []byte
+	if _, err := asn1.Unmarshal(messageDigestAttr.Bytes, &attrDigest); err != nil {
+		return nil, fmt.Errorf("pkg: failed to parse messageDigest attribute: %w", err)
+	}
+	h := digestHash.New()
+	h.Write(sd.ContentInfo.Content.Bytes)
+	if !bytes.Equal(h.Sum(nil), attrDigest) {
+		return nil, fmt.Errorf("pkg: messageDigest attribute does not match the encapsulated content")
+	}
+
+	signedBytes := asUniversalSet(signer.AuthenticatedAttributes.FullBytes)
+	if err := verifySignature(signerCert, digestHash, signedBytes, signer.EncryptedDigest); err != nil {
+		return nil, fmt.Errorf("pkg: signature verification failed: %w", err)
+	}
+
+	verifyOpts := x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   opts.CurrentTime,
+		// Deliberately omits x509.ExtKeyUsageAny: crypto/x509.Verify
+		// treats its presence anywhere in KeyUsages as "skip the EKU
+		// check entirely", which would silently accept certificates
+		// with no code-signing EKU at all.
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	for _, c := range certs {
+		if c != signerCert {
+			verifyOpts.Intermediates.AddCert(c)
+		}
+	}
+	chains, err := signerCert.Verify(verifyOpts)
+	if err != nil {
+		return nil, fmt.Errorf("pkg: failed to chain signer certificate to a trusted root: %w", err)
+	}
+
+	result := &VerifyResult{SignerCertificate: signerCert, Chains: chains}
+	if ts, err := extractCounterSignatureTimestamp(signer); err == nil && ts != nil {
+		result.Timestamp = ts
+	}
+	return result, nil
+}
+
+func findCertificate(certs []*x509.Certificate, serial *big.Int) *x509.Certificate {
+	for _, c := range certs {
+		if c.SerialNumber != nil && serial != nil && c.SerialNumber.Cmp(serial) == 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+func findAttribute(attrs []attribute, oid asn1.ObjectIdentifier) (asn1.RawValue, bool) {
+	for _, a := range attrs {
+		if a.Type.Equal(oid) {
+			return a.Value, true
+		}
+	}
+	return asn1.RawValue{}, false
+}
+
+// verifySignature checks signature against hash.New()'d over signedBytes,
+// using signerCert's public key.
+func verifySignature(signerCert *x509.Certificate, h crypto.Hash, signedBytes, signature []byte) error {
+	digest := h.New()
+	digest.Write(signedBytes)
+	sum := digest.Sum(nil)
+
+	switch pub := signerCert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, h, sum, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, sum, signature) {
+			return fmt.Errorf("ECDSA signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported signer public key type %T", signerCert.PublicKey)
+	}
+}
+
+// tstInfo is the subset of RFC 3161's TSTInfo this package cares about:
+// the time the timestamp authority asserts the signature existed at.
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint asn1.RawValue
+	SerialNumber   *big.Int
+	GenTime        time.Time
+}
+
+// extractCounterSignatureTimestamp looks for an RFC 3161 timestamp token in
+// signer's unauthenticated attributes and, if found, returns the time it
+// asserts.
+func extractCounterSignatureTimestamp(signer signerInfo) (*time.Time, error) {
+	unauthAttrs, err := decodeAttributes(signer.UnauthenticatedAttributes)
+	if err != nil {
+		return nil, err
+	}
+	tokenRaw, ok := findAttribute(unauthAttrs, oidRFC3161Timestamp)
+	if !ok {
+		return nil, nil
+	}
+
+	var token asn1.RawValue
+	if _, err := asn1.Unmarshal(tokenRaw.Bytes, &token); err != nil {
+		return nil, fmt.Errorf("failed to unwrap timestamp token: %w", err)
+	}
+	tsSignedData, err := parseSignedData(token.FullBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timestamp token SignedData: %w", err)
+	}
+
+	// The token's encapsulated content is an OCTET STRING wrapping the
+	// DER-encoded TSTInfo.
+	var tstInfoDER []byte
+	if _, err := asn1.Unmarshal(tsSignedData.ContentInfo.Content.Bytes, &tstInfoDER); err != nil {
+		return nil, fmt.Errorf("failed to unwrap TSTInfo: %w", err)
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(tstInfoDER, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse TSTInfo: %w", err)
+	}
+	return &info.GenTime, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ========================================================================
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// This file implements just enough of the ZIP format to locate and, in
+// place, resize a single stored (uncompressed) entry such as an APPX/MSIX
+// package's AppxSignature.p7x — without re-encoding the whole archive the
+// way archive/zip's Writer would. ZIP64 archives are not supported, which
+// is fine for the package sizes certificate_tag deals with.
+
+const (
+	zipLocalFileHeaderSig   = 0x04034b50
+	zipCentralDirHeaderSig  = 0x02014b50
+	zipEndOfCentralDirSig   = 0x06054b50
+	zipLocalFileHeaderSize  = 30
+	zipCentralDirHeaderSize = 46
+	zipEndOfCentralDirSize  = 22
+
+	zipMethodStored = 0
+)
+
+// zipEntry describes one file found by scanning a ZIP central directory.
+type zipEntry struct {
+	name                string
+	method              uint16
+	compressedSize      uint32
+	localHeaderOffset   uint32
+	centralDirRecOffset int // file offset of this entry's central directory record
+}
+
+// findZipEntry scans contents' central directory for an entry named name.
+func findZipEntry(contents []byte, name string) (*zipEntry, error) {
+	eocdOffset, err := findEndOfCentralDirectory(contents)
+	if err != nil {
+		return nil, err
+	}
+	cdOffset := int(binary.LittleEndian.Uint32(contents[eocdOffset+16 : eocdOffset+20]))
+	count := int(binary.LittleEndian.Uint16(contents[eocdOffset+10 : eocdOffset+12]))
+
+	off := cdOffset
+	for i := 0; i < count; i++ {
+		if off+zipCentralDirHeaderSize > len(contents) {
+			return nil, errors.New("pkg: truncated central directory")
+		}
+		if binary.LittleEndian.Uint32(contents[off:off+4]) != zipCentralDirHeaderSig {
+			return nil, errors.New("pkg: malformed central directory header")
+		}
+		method := binary.LittleEndian.Uint16(contents[off+10 : off+12])
+		compSize := binary.LittleEndian.Uint32(contents[off+20 : off+24])
+		nameLen := int(binary.LittleEndian.Uint16(contents[off+28 : off+30]))
+		extraLen := int(binary.LittleEndian.Uint16(contents[off+30 : off+32]))
+		commentLen := int(binary.LittleEndian.Uint16(contents[off+32 : off+34]))
+		localOffset := binary.LittleEndian.Uint32(contents[off+42 : off+46])
+
+		nameStart := off + zipCentralDirHeaderSize
+		if nameStart+nameLen > len(contents) {
+			return nil, errors.New("pkg: truncated central directory entry name")
+		}
+		entryName := string(contents[nameStart : nameStart+nameLen])
+
+		if entryName == name {
+			return &zipEntry{
+				name:                entryName,
+				method:              method,
+				compressedSize:      compSize,
+				localHeaderOffset:   localOffset,
+				centralDirRecOffset: off,
+			}, nil
+		}
+
+		off = nameStart + nameLen + extraLen + commentLen
+	}
+	return nil, fmt.Errorf("pkg: no ZIP entry named %q", name)
+}
+
+// findEndOfCentralDirectory locates the (non-ZIP64) End Of Central
+// Directory record by scanning backwards from the end of the file.
+func findEndOfCentralDirectory(contents []byte) (int, error) {
+	// The EOCD is at least 22 bytes and may be followed by a comment of
+	// up to 65535 bytes.
+	searchStart := len(contents) - zipEndOfCentralDirSize - 0xffff
+	if searchStart < 0 {
+		searchStart = 0
+	}
+	sig := []byte{0x50, 0x4b, 0x05, 0x06}
+	idx := bytes.LastIndex(contents[searchStart:], sig)
+	if idx == -1 {
+		return 0, errors.New("pkg: not a ZIP file (no End Of Central Directory record)")
+	}
+	return searchStart + idx, nil
+}
+
+// zipEntryDataOffset returns the file offset at which entry's raw data
+// begins, derived from its local file header (whose filename/extra field
+// lengths can, in principle, differ from the central directory's).
+func zipEntryDataOffset(contents []byte, entry *zipEntry) (int, error) {
+	off := int(entry.localHeaderOffset)
+	if off+zipLocalFileHeaderSize > len(contents) {
+		return 0, errors.New("pkg: truncated local file header")
+	}
+	if binary.LittleEndian.Uint32(contents[off:off+4]) != zipLocalFileHeaderSig {
+		return 0, errors.New("pkg: malformed local file header")
+	}
+	nameLen := int(binary.LittleEndian.Uint16(contents[off+26 : off+28]))
+	extraLen := int(binary.LittleEndian.Uint16(contents[off+28 : off+30]))
+	return off + zipLocalFileHeaderSize + nameLen + extraLen, nil
+}
+
+// zipReplaceEntryData returns a copy of contents with the named entry's
+// (which must be stored, i.e. uncompressed) data replaced by newData,
+// patching the local file header, the central directory record, every
+// later entry's local-header-offset field, and the End Of Central
+// Directory record's central-directory offset to match.
+func zipReplaceEntryData(contents []byte, name string, newData []byte) ([]byte, error) {
+	entry, err := findZipEntry(contents, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.method != zipMethodStored {
+		return nil, fmt.Errorf("pkg: ZIP entry %q is compressed (method %d); only stored entries are supported", name, entry.method)
+	}
+	dataStart, err := zipEntryDataOffset(contents, entry)
+	if err != nil {
+		return nil, err
+	}
+	dataEnd := dataStart + int(entry.compressedSize)
+	if dataEnd > len(contents) {
+		return nil, errors.New("pkg: ZIP entry data runs past end of file")
+	}
+	delta := len(newData) - (dataEnd - dataStart)
+
+	out := make([]byte, 0, len(contents)+delta)
+	out = append(out, contents[:dataStart]...)
+	out = append(out, newData...)
+	out = append(out, contents[dataEnd:]...)
+
+	patchU32 := func(offset int, value uint32) {
+		binary.LittleEndian.PutUint32(out[offset:offset+4], value)
+	}
+
+	crc := crc32.ChecksumIEEE(newData)
+
+	localOff := int(entry.localHeaderOffset)
+	patchU32(localOff+14, crc)                  // crc-32
+	patchU32(localOff+18, uint32(len(newData))) // compressed size
+	patchU32(localOff+22, uint32(len(newData))) // uncompressed size
+
+	// The central directory record physically moved by delta if it sits
+	// after the entry's data (the usual case); find it again by offset
+	// rather than trusting the old centralDirRecOffset directly.
+	cdOffset := entry.centralDirRecOffset
+	if cdOffset > dataStart {
+		cdOffset += delta
+	}
+	patchU32(cdOffset+16, crc)                  // crc-32
+	patchU32(cdOffset+20, uint32(len(newData))) // compressed size
+	patchU32(cdOffset+24, uint32(len(newData))) // uncompressed size
+
+	eocdOffset, err := findEndOfCentralDirectory(out)
+	if err != nil {
+		return nil, err
+	}
+
+	// The EOCD's central-directory-offset field still holds its
+	// pre-edit value (we haven't touched it yet); since the central
+	// directory always sits after all entry data, it moved by delta.
+	oldCDOffset := int(binary.LittleEndian.Uint32(out[eocdOffset+16 : eocdOffset+20]))
+	newCDOffset := oldCDOffset
+	if oldCDOffset > dataStart {
+		newCDOffset += delta
+	}
+	count := int(binary.LittleEndian.Uint16(out[eocdOffset+10 : eocdOffset+12]))
+	off := newCDOffset
+	for i := 0; i < count && off+zipCentralDirHeaderSize <= len(out); i++ {
+		thisLocalOffset := binary.LittleEndian.Uint32(out[off+42 : off+46])
+		if int(thisLocalOffset) > localOff {
+			patchU32(off+42, thisLocalOffset+uint32(delta))
+		}
+		nameLen := int(binary.LittleEndian.Uint16(out[off+28 : off+30]))
+		extraLen := int(binary.LittleEndian.Uint16(out[off+30 : off+32]))
+		commentLen := int(binary.LittleEndian.Uint16(out[off+32 : off+34]))
+		off += zipCentralDirHeaderSize + nameLen + extraLen + commentLen
+	}
+
+	patchU32(eocdOffset+16, uint32(newCDOffset)) // offset of central directory, relative to the whole file
+	return out, nil
+}